@@ -44,6 +44,16 @@ func main() {
 		"status_port", 9401, "port for status server")
 	flagStatusAuthIPs := flag.String(
 		"status_auth_ips", "127.0.0.0/8,::1/128", "list of authorized IPs for status server")
+	flagGCInterval := flag.Int(
+		"gc_interval", 60, "seconds between collection of orphaned OVS ports and veths (0 to collect only at startup)")
+	flagFirewall := flag.String(
+		"firewall", "auto", "firewall backend for NAT and port maps (auto, iptables or nftables)")
+	flagQuarantineAcl := flag.String(
+		"quarantine_acl", "", "FAUCET ACL to apply to quarantined containers")
+	flagQuarantineVlan := flag.String(
+		"quarantine_vlan", "", "FAUCET VLAN to move quarantined containers to")
+	flagPolicyDir := flag.String(
+		"policy_dir", "", "directory of YAML network policies to compile to FAUCET ACLs")
 	flag.Parse()
 	if *flagTrace {
 		log.SetLevel(log.TraceLevel)
@@ -53,6 +63,38 @@ func main() {
 	flag.VisitAll(func(f *flag.Flag) {
 		log.Infof("flag: %s: %s", f.Name, f.Value)
 	})
+	if flag.Arg(0) == "cleanup" {
+		cleanupFlags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+		flagDryRun := cleanupFlags.Bool(
+			"dry_run", false, "report dovesnap artifacts and orphans, without removing anything")
+		flagAll := cleanupFlags.Bool(
+			"all", false, "remove all dovesnap networks and artifacts, not just orphans")
+		cleanupFlags.Parse(flag.Args()[1:])
+		c := ovs.NewCleaner(
+			*flagFaucetconfrpcClientName,
+			*flagFaucetconfrpcServerName,
+			*flagFaucetconfrpcServerPort,
+			*flagFaucetconfrpcKeydir,
+			*flagFaucetconfrpcConnRetries)
+		if err := c.Run(*flagDryRun, *flagAll); err != nil {
+			log.Errorf("cleanup failed: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "ctl" {
+		ctlFlags := flag.NewFlagSet("ctl", flag.ExitOnError)
+		flagStatusAddr := ctlFlags.String(
+			"status_addr", "localhost:9401", "address of dovesnap status server")
+		flagNetwork := ctlFlags.String(
+			"network", "", "network of container (required if container is on more than one dovesnap network)")
+		ctlFlags.Parse(flag.Args()[1:])
+		if err := ovs.RunCtl(*flagStatusAddr, *flagNetwork, ctlFlags.Args()); err != nil {
+			log.Errorf("ctl failed: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	d := ovs.NewDriver(
 		*flagFaucetconfrpcClientName,
 		*flagFaucetconfrpcServerName,
@@ -66,7 +108,12 @@ func main() {
 		*flagMirrorBridgeIn,
 		*flagMirrorBridgeOut,
 		*flagStatusServerPort,
-		*flagStatusAuthIPs)
+		*flagStatusAuthIPs,
+		*flagGCInterval,
+		*flagFirewall,
+		*flagQuarantineAcl,
+		*flagQuarantineVlan,
+		*flagPolicyDir)
 	log.Infof("New Docker driver created")
 	h := network.NewHandler(d)
 	log.Infof("Getting ready to serve new Docker driver")
@@ -3,11 +3,9 @@ package ovs
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"reflect"
 	"strings"
 	"sync"
@@ -16,19 +14,35 @@ import (
 	"github.com/docker/docker/api/types/container"
 	networkplugin "github.com/docker/go-plugins-helpers/network"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
 type OFPortType uint32
 type OFVidType uint32
 
 type ContainerState struct {
-	Name       string
-	Id         string
-	OFPort     OFPortType
-	MacAddress string
-	HostIP     string
-	Labels     map[string]string
-	IfName     string
+	Name            string
+	Id              string
+	OFPort          OFPortType
+	MacAddress      string
+	HostIP          string
+	HostIPv6        string
+	Labels          map[string]string
+	Aliases         []string
+	IfName          string
+	VLAN            uint
+	TaggedVLANs     []uint
+	RateLimits      RateLimits
+	Override        ContainerOverride
+	PortSecurityAcl string
+	PolicyAcl       string
+	InlineAcl       string
+	PortAcl         string
+	Mirror          bool
+	PortMaps        []PortMap
+	DHCPClient      DHCPClientLease
+	DHCPHealth      DHCPClientHealth
+	DHCPServerIP    string
 }
 
 type ExternalPortState struct {
@@ -50,6 +64,7 @@ type DynamicNetworkState struct {
 	Containers       map[string]ContainerState
 	ExternalPorts    map[string]ExternalPortState
 	OtherBridgePorts map[string]OtherBridgePortState
+	DHCPLeases       map[string]DHCPLease
 }
 
 type NetworkState struct {
@@ -61,16 +76,35 @@ type NetworkState struct {
 	MTU                  uint
 	PreAllocatePorts     uint
 	Mode                 string
+	Internal             bool
 	AddPorts             string
 	AddCoproPorts        string
 	Gateway              string
 	GatewayMask          string
+	Gateway6             string
+	GatewayMask6         string
 	FlatBindInterface    string
 	UseDHCP              bool
+	DHCPServer           string
+	DHCPRange            string
+	DHCPRouter           string
+	DHCPDNS              string
+	DHCPLeaseTime        uint
+	DHCPReservations     string
+	DHCPResolvConf       bool
 	Userspace            bool
+	IPv6RA               bool
+	IPv6DNS              string
+	DNS                  bool
+	DNSUpstream          string
+	PortSecurity         bool
 	NATAcl               string
+	NATAclRules          string
+	NATSource            string
 	VLANOutAcl           string
+	VLANOutAclRules      string
 	DefaultAcl           string
+	DefaultAclRules      string
 	OvsLocalMac          string
 	Controller           string
 	DynamicNetworkStates DynamicNetworkState
@@ -80,6 +114,8 @@ type DovesnapOpReply struct {
 	NewNetworkState    NetworkState
 	NewOFPortContainer OFPortContainer
 	NetworkStateString string
+	EndpointInfo       map[string]string
+	Err                error
 }
 
 type DovesnapOp struct {
@@ -93,6 +129,13 @@ type DovesnapOp struct {
 	EndpointID           string
 	Options              map[string]interface{}
 	OFPort               OFPortType
+	DHCPClientLease      DHCPClientLease
+	DHCPClientHealth     DHCPClientHealth
+	Container            string
+	NetworkName          string
+	Override             ContainerOverride
+	Policies             []NetworkPolicy
+	PolicyName           string
 	Reply                chan DovesnapOpReply
 }
 
@@ -117,9 +160,12 @@ type StackingPort struct {
 
 type OFPortContainer struct {
 	OFPort           OFPortType
+	NetworkID        string
 	containerInspect container.InspectResponse
-	udhcpcCmd        *exec.Cmd
+	dhcpClient       *dhcpClient
 	Options          map[string]interface{}
+	portMaps         []PortMap
+	state            string
 }
 
 type Driver struct {
@@ -134,7 +180,22 @@ type Driver struct {
 	stackDefaultControllers string
 	mirrorBridgeIn          string
 	mirrorBridgeOut         string
-	lastDhcpMtime           time.Time
+	lastGC                  time.Time
+	gcInterval              time.Duration
+	gcSuspects              map[string]bool
+	firewall                firewaller
+	raServers               map[string]*raServer
+	dhcpServers             map[string]*dhcpServer
+	dnsServers              map[string]*dnsServer
+	containerOverrides      containerOverrides
+	quarantineAcl           string
+	quarantineVlan          uint
+	policyDir               string
+	policyDirStamp          string
+	dirPolicies             map[string]NetworkPolicy
+	apiPolicies             map[string]NetworkPolicy
+	faucetAcls              map[string]string
+	portSecurityRules       map[string]int
 	shortEngineId           string
 	mirrorBridgeName        string
 	loopbackBridgeName      string
@@ -148,6 +209,14 @@ type Driver struct {
 
 const (
 	chanSize = 64
+
+	// Endpoint has a veth and OVS port (CreateEndpoint()).
+	endpointReserved = "reserved"
+	// Join() started but did not complete, or Leave() did not remove the FAUCET interface (FAUCET may be
+	// partially configured).
+	endpointJoining = "joining"
+	// Endpoint is attached to a container and configured in FAUCET (Join()).
+	endpointJoined = "joined"
 )
 
 func (d *Driver) createLoopbackBridge() error {
@@ -285,23 +354,93 @@ func (d *Driver) ReOrCreateNetwork(r *networkplugin.CreateNetworkRequest, operat
 	add_ports := mustGetBridgeAddPorts(r)
 	add_copro_ports := mustGetBridgeAddCoproPorts(r)
 	gateway, mask := mustGetGatewayIP(r)
+	gateway6, mask6 := mustGetGatewayIPv6(r)
 	useDHCP := mustGetUseDHCP(r)
+	dhcpServer := mustGetDHCPServer(r)
+	dhcpResolvConf := mustGetDHCPResolvConf(r)
 	useUserspace := mustGetUserspace(r)
+	ipv6RA := mustGetIPv6RA(r)
+	ipv6DNS := mustGetIPv6DNS(r)
+	dns := mustGetDNS(r)
+	dnsUpstream := mustGetDNSUpstream(r)
 	natAcl := mustGetNATAcl(r)
+	natSource := mustGetNATSource(r)
 	ovsLocalMac := mustGetOvsLocalMac(r)
 	vlanOutAcl := mustGetBridgeVLANOutAcl(r)
 	defaultAcl := mustGetDefaultAcl(r)
+	natAclRules := mustGetNATAclRules(r)
+	vlanOutAclRules := mustGetBridgeVLANOutAclRules(r)
+	defaultAclRules := mustGetDefaultAclRules(r)
 
 	if useDHCP {
 		if mode != "flat" {
 			panic(fmt.Errorf("network must be flat when DHCP in use"))
 		}
-		if gateway != "" {
+		if gateway != "" || gateway6 != "" {
 			panic(fmt.Errorf("network must not have IP config when DHCP in use"))
 		}
 		if !mustGetInternalOption(r) {
 			panic(fmt.Errorf("network must be internal when DHCP in use"))
 		}
+	} else if dhcpServer != "" {
+		panic(fmt.Errorf("DHCP must be in use when DHCP server in use"))
+	} else if dhcpResolvConf {
+		panic(fmt.Errorf("DHCP must be in use when DHCP resolv.conf in use"))
+	}
+
+	if bindInterface != "" && mode != modeFlat && !validateIface(bindInterface) {
+		panic(fmt.Errorf("bind interface %s does not exist", bindInterface))
+	}
+	if natSource != "" {
+		if mode != modeNAT {
+			panic(fmt.Errorf("network must be nat when NAT source address in use"))
+		}
+		if net.ParseIP(natSource) == nil {
+			panic(fmt.Errorf("invalid NAT source address %s", natSource))
+		}
+	}
+
+	if ipv6RA {
+		if mode != modeRouted {
+			panic(fmt.Errorf("network must be routed when router advertisements in use"))
+		}
+		if ipFamily(gateway) != netlink.FAMILY_V6 && gateway6 == "" {
+			panic(fmt.Errorf("network must have an IPv6 gateway when router advertisements in use"))
+		}
+	}
+	if ipv6DNS != "" {
+		if !ipv6RA {
+			panic(fmt.Errorf("router advertisements must be in use when IPv6 DNS servers in use"))
+		}
+		if _, err := parseIPv6DNS(ipv6DNS); err != nil {
+			panic(err)
+		}
+	}
+
+	if dns {
+		if useDHCP {
+			panic(fmt.Errorf("network must not use DHCP when DNS in use"))
+		}
+		if mode != modeNAT && mode != modeRouted {
+			panic(fmt.Errorf("network must be nat or routed when DNS in use"))
+		}
+		if gateway == "" {
+			panic(fmt.Errorf("network must have a gateway when DNS in use"))
+		}
+	} else if dnsUpstream != "" {
+		panic(fmt.Errorf("DNS must be in use when DNS upstream in use"))
+	}
+
+	for _, rulesStr := range []string{natAclRules, vlanOutAclRules, defaultAclRules} {
+		if rulesStr != "" {
+			mustParseAclRules(rulesStr)
+		}
+	}
+	if natAclRules != "" && mode != modeNAT && mode != modeRouted {
+		panic(fmt.Errorf("network must be nat or routed when NAT ACL rules in use"))
+	}
+	if vlanOutAclRules != "" && vlanOutAcl != "" {
+		panic(fmt.Errorf("VLAN out ACL and VLAN out ACL rules cannot both be in use"))
 	}
 
 	// TODO: Frustratingly, when docker creates a network, it doesn't tell us the network's name.
@@ -316,21 +455,51 @@ func (d *Driver) ReOrCreateNetwork(r *networkplugin.CreateNetworkRequest, operat
 		MTU:                  mtu,
 		PreAllocatePorts:     preAllocatePorts,
 		Mode:                 mode,
+		Internal:             mustGetInternalOption(r),
 		AddPorts:             add_ports,
 		AddCoproPorts:        add_copro_ports,
 		Gateway:              gateway,
 		GatewayMask:          mask,
+		Gateway6:             gateway6,
+		GatewayMask6:         mask6,
 		FlatBindInterface:    bindInterface,
 		UseDHCP:              useDHCP,
+		DHCPServer:           dhcpServer,
+		DHCPRange:            mustGetDHCPRange(r),
+		DHCPRouter:           mustGetDHCPRouter(r),
+		DHCPDNS:              mustGetDHCPDNS(r),
+		DHCPLeaseTime:        mustGetDHCPLeaseTime(r),
+		DHCPReservations:     mustGetDHCPReservations(r),
+		DHCPResolvConf:       dhcpResolvConf,
 		Userspace:            useUserspace,
+		IPv6RA:               ipv6RA,
+		IPv6DNS:              ipv6DNS,
+		DNS:                  dns,
+		DNSUpstream:          dnsUpstream,
+		PortSecurity:         mustGetPortSecurity(r),
 		NATAcl:               natAcl,
+		NATAclRules:          natAclRules,
+		NATSource:            natSource,
 		VLANOutAcl:           vlanOutAcl,
+		VLANOutAclRules:      vlanOutAclRules,
 		DefaultAcl:           defaultAcl,
+		DefaultAclRules:      defaultAclRules,
 		OvsLocalMac:          ovsLocalMac,
 		Controller:           controller,
 		DynamicNetworkStates: makeDynamicNetworkState(d.shortEngineId),
 	}
 
+	if ns.DHCPServer != "" {
+		if _, err := newDhcpServer(r.NetworkID, ns); err != nil {
+			panic(err)
+		}
+	}
+	if ns.DNS {
+		if _, err := getDNSUpstreams(ns); err != nil {
+			panic(err)
+		}
+	}
+
 	// Validate add_ports/add_copro_ports if present.
 	addPorts := make(map[string]OFPortType)
 	addPortsAcls := make(map[OFPortType]string)
@@ -374,9 +543,16 @@ func (d *Driver) DeleteNetwork(r *networkplugin.DeleteNetworkRequest) error {
 	return nil
 }
 
-func (d *Driver) CreateEndpoint(r *networkplugin.CreateEndpointRequest) (*networkplugin.CreateEndpointResponse, error) {
+func (d *Driver) CreateEndpoint(r *networkplugin.CreateEndpointRequest) (res *networkplugin.CreateEndpointResponse, err error) {
 	log.Debugf("Create endpoint request: %+v", r)
 	localVethPair := vethPair(truncateID(r.EndpointID))
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			err = fmt.Errorf("cannot create endpoint: %v", rerr)
+			res = nil
+			netlink.LinkDel(localVethPair)
+		}
+	}()
 	addVethPair(localVethPair)
 	vethName := localVethPair.PeerName
 	macAddress := r.Interface.MacAddress
@@ -395,7 +571,11 @@ func (d *Driver) CreateEndpoint(r *networkplugin.CreateEndpointRequest) (*networ
 		Reply:      make(chan DovesnapOpReply, 2),
 	}
 	d.dovesnapOpChan <- reservePortMsg
-	res := &networkplugin.CreateEndpointResponse{
+	reply := <-reservePortMsg.Reply
+	if reply.Err != nil {
+		panic(reply.Err)
+	}
+	res = &networkplugin.CreateEndpointResponse{
 		Interface: &networkplugin.EndpointInterface{MacAddress: macAddress},
 	}
 	log.Debugf("Create endpoint response: %+v", res)
@@ -412,12 +592,29 @@ func (d *Driver) GetCapabilities() (*networkplugin.CapabilitiesResponse, error)
 
 func (d *Driver) ProgramExternalConnectivity(r *networkplugin.ProgramExternalConnectivityRequest) error {
 	log.Debugf("Program external connectivity request: %+v", r)
-	return nil
+	programMsg := DovesnapOp{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+		Options:    r.Options,
+		Operation:  "programexternal",
+		Reply:      make(chan DovesnapOpReply, 2),
+	}
+	d.dovesnapOpChan <- programMsg
+	reply := <-programMsg.Reply
+	return reply.Err
 }
 
 func (d *Driver) RevokeExternalConnectivity(r *networkplugin.RevokeExternalConnectivityRequest) error {
 	log.Debugf("Revoke external connectivity request: %+v", r)
-	return nil
+	revokeMsg := DovesnapOp{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+		Operation:  "revokeexternal",
+		Reply:      make(chan DovesnapOpReply, 2),
+	}
+	d.dovesnapOpChan <- revokeMsg
+	reply := <-revokeMsg.Reply
+	return reply.Err
 }
 
 func (d *Driver) FreeNetwork(r *networkplugin.FreeNetworkRequest) error {
@@ -437,6 +634,14 @@ func (d *Driver) DiscoverDelete(r *networkplugin.DiscoveryNotification) error {
 
 func (d *Driver) DeleteEndpoint(r *networkplugin.DeleteEndpointRequest) error {
 	log.Debugf("Delete endpoint request: %+v", r)
+	deleteEndpointMsg := DovesnapOp{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+		Operation:  "deleteendpoint",
+		Reply:      make(chan DovesnapOpReply, 2),
+	}
+	d.dovesnapOpChan <- deleteEndpointMsg
+	<-deleteEndpointMsg.Reply
 	return nil
 }
 
@@ -449,8 +654,17 @@ func (d *Driver) AllocateNetwork(r *networkplugin.AllocateNetworkRequest) (*netw
 }
 
 func (d *Driver) EndpointInfo(r *networkplugin.InfoRequest) (*networkplugin.InfoResponse, error) {
+	log.Debugf("Endpoint info request: %+v", r)
+	infoMsg := DovesnapOp{
+		NetworkID:  r.NetworkID,
+		EndpointID: r.EndpointID,
+		Operation:  "endpointinfo",
+		Reply:      make(chan DovesnapOpReply, 2),
+	}
+	d.dovesnapOpChan <- infoMsg
+	reply := <-infoMsg.Reply
 	res := &networkplugin.InfoResponse{
-		Value: make(map[string]string),
+		Value: reply.EndpointInfo,
 	}
 	return res, nil
 }
@@ -473,7 +687,13 @@ func (d *Driver) Join(r *networkplugin.JoinRequest) (*networkplugin.JoinResponse
 			SrcName:   localVethPair.PeerName,
 			DstPrefix: containerEthName,
 		},
-		Gateway: ns.Gateway,
+		Gateway:     ns.Gateway,
+		GatewayIPv6: ns.Gateway6,
+	}
+	if gatewayIP := net.ParseIP(ns.Gateway); gatewayIP != nil && gatewayIP.To4() == nil {
+		// IPv6 only network.
+		res.Gateway = ""
+		res.GatewayIPv6 = ns.Gateway
 	}
 	log.Debugf("Join endpoint response %+v", r)
 	return res, nil
@@ -520,13 +740,27 @@ func mustHandleDeleteNetwork(d *Driver, opMsg DovesnapOp) {
 	log.Infof("Deleting network ID %s bridge %s", opMsg.NetworkID, ns.BridgeName)
 
 	d.faucetconfrpcer.mustDeleteDp(ns.NetworkName)
+	for _, acl := range getNetworkInlineAcls(ns) {
+		// Networks can share a VLAN, so its out ACL is left for GC once unused.
+		if acl != networkInlineAclName(ns, inlineVLANOutAcl) {
+			d.deleteFaucetAcl(acl)
+		}
+	}
 
-	if ns.Mode == modeNAT {
-		gatewayIP := ns.Gateway + "/" + ns.GatewayMask
-		if err := natOut(gatewayIP, "-D"); err != nil {
-			log.Fatalf("Could not delete NAT rules for bridge %s because %v", ns.BridgeName, err)
-			panic(err)
+	if ns.Mode == modeNAT || ns.Mode == modeRouted {
+		for _, eg := range getEgressConfigs(ns) {
+			if err := d.firewall.egress(eg, false); err != nil {
+				log.Fatalf("Could not delete NAT rules for bridge %s because %v", ns.BridgeName, err)
+				panic(err)
+			}
 		}
+		deletePolicyRouting(ns)
+	}
+	d.stopRA(opMsg.NetworkID)
+	d.stopDhcpServer(opMsg.NetworkID)
+	d.stopDNS(opMsg.NetworkID)
+	if ns.DHCPServer != "" && opMsg.Operation == "delete" {
+		os.Remove(dhcpLeaseFile(ns.BridgeName))
 	}
 
 	d.mustDeleteBridgeAndPorts(ns.BridgeName)
@@ -567,9 +801,10 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 	ns.NetworkName = inspectNs.NetworkName
 	d.networks[opMsg.NetworkID] = ns
 	egressPipeline := false
-	if ns.VLANOutAcl != "" {
+	if ns.VLANOutAcl != "" || ns.VLANOutAclRules != "" {
 		egressPipeline = true
 	}
+	d.mustSetNetworkInlineAcls(ns)
 
 	add_ports := opMsg.AddPorts
 	add_interfaces := ""
@@ -603,11 +838,13 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 			ns.DynamicNetworkStates.ExternalPorts[add_port] = getExternalPortState(add_port, ofPort)
 		}
 	}
-	nextPrePort := d.ovsdber.mustLowestFreePortOnBridge(ns.BridgeName)
-	defaultAcl := ""
-	if len(ns.DefaultAcl) > 0 {
-		defaultAcl = getStrForNetwork(ns.DefaultAcl, ns.NetworkName)
+	if ns.DHCPServer != "" {
+		portName, ofPort := d.mustAddDhcpServerPort(opMsg.NetworkID, ns)
+		add_interfaces += d.faucetconfrpcer.vlanInterfaceYaml(ofPort, "DHCP server", ns.BridgeVLAN, "")
+		ns.DynamicNetworkStates.ExternalPorts[portName] = getExternalPortState(portName, ofPort)
 	}
+	nextPrePort := d.ovsdber.mustLowestFreePortOnBridge(ns.BridgeName)
+	defaultAcl := getNetworkAcls(ns, inlineDefaultAcl, getStrForNetwork(ns.DefaultAcl, ns.NetworkName))
 	for prePort := uint(0); prePort < ns.PreAllocatePorts; prePort++ {
 		log.Debugf("preallocating port %d on %s", nextPrePort, ns.NetworkName)
 		add_interfaces += d.faucetconfrpcer.vlanInterfaceYaml(nextPrePort, "preallocated port", ns.BridgeVLAN, defaultAcl)
@@ -615,7 +852,7 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 	}
 	mode := opMsg.Mode
 	if mode == "nat" || mode == "routed" {
-		netAcl := getStrForNetwork(ns.NATAcl, ns.NetworkName)
+		netAcl := getNetworkAcls(ns, inlineNATAcl, getStrForNetwork(ns.NATAcl, ns.NetworkName))
 		// TODO: consider the bridge port to be always up - determine why OVS doesn't always update us with port status.
 		add_interfaces += d.faucetconfrpcer.localVlanInterfaceYaml(ofPortLocal, "OVS Port default gateway", ns.BridgeVLAN, netAcl)
 		ns.DynamicNetworkStates.ExternalPorts[inspectNs.BridgeName] = getExternalPortState(inspectNs.BridgeName, ofPortLocal)
@@ -648,7 +885,7 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 		configYaml = fmt.Sprintf("{dps: {%s %s}}", localDpYaml, remoteDpYaml)
 	}
 	d.faucetconfrpcer.mustSetFaucetConfigFile(configYaml)
-	vlanOutAcl := getStrForNetwork(ns.VLANOutAcl, ns.NetworkName)
+	vlanOutAcl := getNetworkAcls(ns, inlineVLANOutAcl, getStrForNetwork(ns.VLANOutAcl, ns.NetworkName))
 	if vlanOutAcl != "" {
 		d.faucetconfrpcer.mustSetVlanOutAcl(fmt.Sprintf("%d", ns.BridgeVLAN), vlanOutAcl)
 	}
@@ -668,6 +905,9 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 			d.faucetconfrpcer.mustSetPortAcl(ns.NetworkName, port_no, networkAcls)
 		}
 	}
+	d.startRA(opMsg.NetworkID, ns)
+	d.startDhcpServer(opMsg.NetworkID, ns)
+	d.startDNS(opMsg.NetworkID, ns)
 	d.notifyMsgChan <- NotifyMsg{
 		Type:         "NETWORK",
 		Operation:    "CREATE",
@@ -675,18 +915,6 @@ func mustHandleCreateNetwork(d *Driver, opMsg DovesnapOp) {
 	}
 }
 
-func mustGetPortMap(portMapRaw interface{}) (string, string, string) {
-	portMap := portMapRaw.(map[string]interface{})
-	hostPort := fmt.Sprintf("%d", int(portMap["HostPort"].(float64)))
-	port := fmt.Sprintf("%d", int(portMap["Port"].(float64)))
-	ipProtoName := "tcp"
-	ipProto := int(portMap["Proto"].(float64))
-	if ipProto == 17 {
-		ipProtoName = "udp"
-	}
-	return hostPort, port, ipProtoName
-}
-
 func mustHandleGetNetwork(d *Driver, opMsg DovesnapOp) {
 	reply := DovesnapOpReply{}
 
@@ -703,16 +931,75 @@ func mustHandleGetNetwork(d *Driver, opMsg DovesnapOp) {
 }
 
 func mustHandleReservePort(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	reply := DovesnapOpReply{}
+	ns := d.networks[opMsg.NetworkID]
+	localVethPair := vethPair(truncateID(opMsg.EndpointID))
+	vethName := localVethPair.Name
+
 	defer func() {
 		if rerr := recover(); rerr != nil {
 			log.Errorf("mustHandleReservePort failed: %v", rerr)
+			VsCtl("--if-exists", "del-port", ns.BridgeName, vethName)
+			reply.Err = fmt.Errorf("cannot reserve port: %v", rerr)
 		}
+		opMsg.Reply <- reply
 	}()
-	ns := d.networks[opMsg.NetworkID]
-	localVethPair := vethPair(truncateID(opMsg.EndpointID))
-	vethName := localVethPair.Name
+
 	ofPort, _ := d.mustAddInternalPort(ns.BridgeName, vethName, 0)
-	(*OFPorts)[opMsg.EndpointID] = OFPortContainer{OFPort: ofPort}
+	(*OFPorts)[opMsg.EndpointID] = OFPortContainer{
+		OFPort:    ofPort,
+		NetworkID: opMsg.NetworkID,
+		state:     endpointReserved,
+	}
+}
+
+// mustHandleEndpointInfo reports dovesnap's view of an endpoint, for docker inspect.
+func mustHandleEndpointInfo(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	info := make(map[string]string)
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleEndpointInfo failed: %v", rerr)
+		}
+		opMsg.Reply <- DovesnapOpReply{EndpointInfo: info}
+	}()
+
+	ns, ok := d.networks[opMsg.NetworkID]
+	if !ok {
+		panic(fmt.Errorf("network %s not found", opMsg.NetworkID))
+	}
+	info["dovesnap.bridge"] = ns.BridgeName
+	info["dovesnap.dpid"] = ns.BridgeDpid
+	info["dovesnap.dp"] = ns.NetworkName
+	info["dovesnap.vlan"] = fmt.Sprintf("%d", ns.BridgeVLAN)
+	containerMap, ok := (*OFPorts)[opMsg.EndpointID]
+	if !ok {
+		return
+	}
+	info["dovesnap.ofport"] = fmt.Sprintf("%d", containerMap.OFPort)
+	info["dovesnap.state"] = containerMap.state
+	containerState, ok := ns.DynamicNetworkStates.Containers[opMsg.EndpointID]
+	if !ok {
+		return
+	}
+	info["dovesnap.ifname"] = containerState.IfName
+	info["dovesnap.vlan"] = fmt.Sprintf("%d", containerState.VLAN)
+	if len(containerState.TaggedVLANs) > 0 {
+		info["dovesnap.tagged_vlans"] = formatVLANs(containerState.TaggedVLANs)
+	}
+	info["dovesnap.acls_in"] = containerState.PortAcl
+	info["dovesnap.ingress_rate"] = fmt.Sprintf("%d", containerState.RateLimits.IngressKbps)
+	info["dovesnap.egress_rate"] = fmt.Sprintf("%d", containerState.RateLimits.EgressKbps)
+	info["dovesnap.mirror"] = fmt.Sprintf("%t", containerState.Mirror)
+	portMaps := []string{}
+	for _, pm := range containerState.PortMaps {
+		portMaps = append(portMaps, pm.String())
+	}
+	info["dovesnap.portmaps"] = strings.Join(portMaps, ",")
+	if ns.UseDHCP {
+		info["dovesnap.dhcp_address"] = containerState.HostIP
+		info["dovesnap.dhcp_state"] = containerState.DHCPHealth.State
+	}
 }
 
 func mustHandleJoinContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
@@ -722,8 +1009,14 @@ func mustHandleJoinContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OF
 		}
 	}()
 
-	ofPort := (*OFPorts)[opMsg.EndpointID].OFPort
+	reservedPort, reserved := (*OFPorts)[opMsg.EndpointID]
+	if !reserved || reservedPort.state != endpointReserved {
+		panic(fmt.Errorf("endpoint %s was not created", opMsg.EndpointID))
+	}
+	ofPort := reservedPort.OFPort
 	ns := d.networks[opMsg.NetworkID]
+	reservedPort.state = endpointJoining
+	(*OFPorts)[opMsg.EndpointID] = reservedPort
 
 	log.Debugf("about to inspect %+v on %+v", opMsg.EndpointID, ns)
 	containerInspect, err := d.dockerer.getContainerFromEndpoint(opMsg.NetworkID, opMsg.EndpointID)
@@ -734,158 +1027,287 @@ func mustHandleJoinContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OF
 	containerNetSettings := containerInspect.NetworkSettings.Networks[ns.NetworkName]
 	macAddress := containerNetSettings.MacAddress
 
-	createNsLink(pid, containerInspect.ID)
-	defaultInterface := "eth0"
+	cns, err := openContainerNetNs(pid)
+	if err != nil {
+		panic(err)
+	}
+	defer cns.Close()
+	ifName := mustGetContainerIfName(cns, opMsg.EndpointID)
 
 	macPrefix, mok := containerInspect.Config.Labels["dovesnap.faucet.mac_prefix"]
 	if mok && len(macPrefix) > 0 {
 		oldMacAddress := macAddress
-		macAddress := mustPrefixMAC(macPrefix, macAddress)
+		macAddress = mustPrefixMAC(macPrefix, macAddress)
 		log.Infof("mapping MAC from %s to %s using prefix %s", oldMacAddress, macAddress, macPrefix)
-		output, err := exec.Command("ip", "netns", "exec", containerInspect.ID, "ip", "link", "set", defaultInterface, "address", macAddress).CombinedOutput()
-		log.Debugf("%s", output)
-		if err != nil {
+		if err := cns.setMAC(ifName, macAddress); err != nil {
 			panic(err)
 		}
 	}
 	if ns.Userspace {
-		output, err := exec.Command("ip", "netns", "exec", containerInspect.ID, "/sbin/ethtool", "-K", defaultInterface, "tx", "off").CombinedOutput()
-		log.Debugf("%s", output)
-		if err != nil {
+		if err := cns.disableTxChecksum(ifName); err != nil {
 			panic(err)
 		}
 	}
 
-	log.Infof("Adding %s (pid %d) MAC %s on %s DPID %d OFPort %d to Faucet",
-		containerInspect.Name, pid, macAddress, ns.BridgeName, ns.BridgeDpidUint, ofPort)
+	log.Infof("Adding %s (pid %d) %s MAC %s on %s DPID %d OFPort %d to Faucet",
+		containerInspect.Name, pid, ifName, macAddress, ns.BridgeName, ns.BridgeDpidUint, ofPort)
 	log.Debugf("container network settings: %+v", containerNetSettings)
 
-	log.Debugf("%+v", opMsg.Options[portMapOption])
 	hostIP := containerNetSettings.IPAddress
-	gatewayIP := containerNetSettings.Gateway
 
-	// Regular docker uses docker proxy, to listen on the configured port and proxy them into the container.
-	// dovesnap doesn't get to use docker proxy, so we listen on the configured port on the network's gateway instead.
-	for _, portMapRaw := range opMsg.Options[portMapOption].([]interface{}) {
-		log.Debugf("adding portmap %+v", portMapRaw)
-		hostPort, port, ipProto := mustGetPortMap(portMapRaw)
-		mustAddGatewayPortMap(ns.BridgeName, ipProto, gatewayIP, hostIP, hostPort, port)
-	}
-
-	portAcl := ""
-	portAcl, ok := containerInspect.Config.Labels["dovesnap.faucet.portacl"]
-	defaultAcl := ns.DefaultAcl
-	if ok && len(portAcl) > 0 {
-		portAcl = getStrForNetwork(portAcl, ns.NetworkName)
-		if portAcl != "" {
-			log.Infof("Set portacl %s on %s", portAcl, containerInspect.Name)
-		}
-	} else if len(defaultAcl) > 0 {
-		portAcl = getStrForNetwork(defaultAcl, ns.NetworkName)
-		if defaultAcl != "" {
-			log.Infof("set default portacl %s on %s", portAcl, containerInspect.Name)
-		}
+	override := d.containerOverrides[containerOverrideKey(ns.NetworkName, containerInspect.ID)]
+	inlineAcl := ""
+	if rules, ok := containerInspect.Config.Labels["dovesnap.faucet.portacl_rules"]; ok && len(rules) > 0 {
+		inlineAcl = d.mustSetInlineAcl(containerInlineAclName(opMsg.EndpointID), rules)
+	}
+	portAcl := getLabelPortAcl(ns, opMsg.EndpointID, containerInspect.Config.Labels)
+	if override.PortAcl != nil {
+		portAcl = *override.PortAcl
+	}
+	labelVlan, labelTaggedVlans := mustGetLabelVLANs(d, ns, containerInspect.Config.Labels, containerInspect.Name)
+	vlan, taggedVlans := labelVlan, labelTaggedVlans
+	mirror := getLabelMirror(ns, containerInspect.Config.Labels)
+	if override.Mirror != nil {
+		mirror = *override.Mirror
+	}
+	labelRateLimits := mustGetRateLimits(ns, containerInspect.Config.Labels)
+	mustCheckMeteredPortAcl(ns.Userspace && labelRateLimits.EgressKbps > 0, portAcl)
+	if override.Quarantine != nil {
+		log.Warnf("%s is quarantined", containerInspect.Name)
+		portAcl, vlan, taggedVlans = d.mustGetQuarantinePortConfig(ns, portAcl, vlan, taggedVlans)
+		mirror = true
+	}
+	if portAcl != "" {
+		log.Infof("Set portacl %s on %s", portAcl, containerInspect.Name)
+	}
+
+	rateLimits := d.mustSetRateLimits(ns, vethPair(truncateID(opMsg.EndpointID)).Name, ofPort, labelRateLimits)
+	portSecurityAcl := ""
+	if ns.PortSecurity {
+		portSecurityAcl = d.mustSetPortSecurityAcl(opMsg.NetworkID, opMsg.EndpointID, ContainerState{
+			Name:       containerInspect.Name,
+			MacAddress: macAddress,
+			HostIP:     hostIP,
+			HostIPv6:   containerNetSettings.GlobalIPv6Address,
+		})
+	}
+	portAcls := getPortAcls(portSecurityAcl, "", portAcl, rateLimits)
+	if rateLimits.Meter != "" {
+		log.Infof("Set egress rate %d kbps on %s", rateLimits.EgressKbps, containerInspect.Name)
+	}
+
+	portDescription := fmt.Sprintf("%s %s", containerInspect.Name, truncateID(containerInspect.ID))
+	add_interfaces := d.faucetconfrpcer.vlanInterfaceYaml(ofPort, portDescription, vlan, portAcls)
+	if len(taggedVlans) > 0 {
+		add_interfaces = d.faucetconfrpcer.taggedVlanInterfaceYaml(ofPort, portDescription, vlan, taggedVlans, portAcls)
 	}
-	add_interfaces := d.faucetconfrpcer.vlanInterfaceYaml(
-		ofPort, fmt.Sprintf("%s %s", containerInspect.Name, truncateID(containerInspect.ID)), ns.BridgeVLAN, portAcl)
 
 	d.faucetconfrpcer.mustSetFaucetConfigFile(d.faucetconfrpcer.mergeSingleDpMinimalYaml(
 		ns.NetworkName, add_interfaces))
 
-	mirror, ok := containerInspect.Config.Labels["dovesnap.faucet.mirror"]
-	if ok && parseBool(getStrForNetwork(mirror, ns.NetworkName)) {
+	mirrored := false
+	if mirror {
 		log.Infof("Mirroring container %s", containerInspect.Name)
 		stackMirrorConfig := d.stackMirrorConfigs[opMsg.NetworkID]
 		if usingStackMirroring(d) || usingMirrorBridge(d) {
 			d.faucetconfrpcer.mustAddPortMirror(ns.NetworkName, ofPort, stackMirrorConfig.LbPort)
+			mirrored = true
 		}
 	}
 
-	udhcpcCmd := exec.Command("ip", "netns", "exec", containerInspect.ID, "/sbin/udhcpc", "-f", "-R", "-i", defaultInterface, "-s", "/udhcpclog.sh")
-	udhcpcCmd.Env = os.Environ()
-	udhcpcCmd.Env = append(udhcpcCmd.Env, fmt.Sprintf("CONTAINER_ID=%s", containerInspect.ID))
-	if ns.UseDHCP {
-		err = udhcpcCmd.Start()
+	subinterfaces, ok := containerInspect.Config.Labels["dovesnap.faucet.vlan_subinterfaces"]
+	if ok && parseBool(getStrForNetwork(subinterfaces, ns.NetworkName)) {
+		for _, taggedVlan := range labelTaggedVlans {
+			if err := cns.addVlanSubinterface(ifName, taggedVlan); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	if s, ok := d.dhcpServers[opMsg.NetworkID]; ok {
+		reservedIP, err := getDhcpReservation(ns, containerInspect.Config.Labels)
 		if err != nil {
 			panic(err)
 		}
-		log.Infof("started udhcpc for %s", containerInspect.ID)
-	} else {
-		udhcpcCmd = nil
+		if reservedIP != nil {
+			log.Infof("reserving DHCP address %s for %s", reservedIP, containerInspect.Name)
+			if err := s.reserve(mustParseMAC(macAddress), reservedIP); err != nil {
+				panic(err)
+			}
+		}
+	}
+	// Start the DHCP client last, so that it is always recorded in OFPorts (for Leave() to stop).
+	var dhcpClient *dhcpClient
+	if ns.UseDHCP {
+		dhcpClient = startDhcpClient(d, opMsg.NetworkID, opMsg.EndpointID, containerInspect.ID, pid, ifName, ns.DHCPResolvConf)
 	}
+	portMaps := []PortMap{}
 	containerMap := OFPortContainer{
 		OFPort:           ofPort,
+		NetworkID:        opMsg.NetworkID,
 		containerInspect: containerInspect,
-		udhcpcCmd:        udhcpcCmd,
+		dhcpClient:       dhcpClient,
 		Options:          opMsg.Options,
+		state:            endpointJoined,
 	}
 	(*OFPorts)[opMsg.EndpointID] = containerMap
-	ns.DynamicNetworkStates.Containers[opMsg.EndpointID] = ContainerState{
-		Name:       containerInspect.Name,
-		Id:         containerInspect.ID,
-		OFPort:     ofPort,
-		HostIP:     hostIP,
-		MacAddress: macAddress,
-		Labels:     containerInspect.Config.Labels,
-		IfName:     defaultInterface,
+	// Docker never calls ProgramExternalConnectivity() for internal networks, so we must program port maps here.
+	if ns.Internal {
+		portMaps = mustProgramPortMaps(d, opMsg.EndpointID, opMsg.Options, OFPorts)
 	}
+	dhcpHealth := DHCPClientHealth{}
+	if dhcpClient != nil {
+		dhcpHealth.State = dhcpClientRequesting
+	}
+	ns.DynamicNetworkStates.Containers[opMsg.EndpointID] = ContainerState{
+		Name:            containerInspect.Name,
+		Id:              containerInspect.ID,
+		OFPort:          ofPort,
+		HostIP:          hostIP,
+		HostIPv6:        containerNetSettings.GlobalIPv6Address,
+		MacAddress:      macAddress,
+		Labels:          containerInspect.Config.Labels,
+		Aliases:         containerNetSettings.Aliases,
+		IfName:          ifName,
+		VLAN:            vlan,
+		TaggedVLANs:     taggedVlans,
+		RateLimits:      rateLimits,
+		Override:        override,
+		PortSecurityAcl: portSecurityAcl,
+		InlineAcl:       inlineAcl,
+		PortAcl:         portAcl,
+		Mirror:          mirrored,
+		PortMaps:        portMaps,
+		DHCPHealth:      dhcpHealth,
+	}
+	d.updateDNS(opMsg.NetworkID)
+	compilePolicies(d, opMsg.NetworkID)
 
 	d.notifyMsgChan <- NotifyMsg{
 		Type:         "CONTAINER",
 		Operation:    "JOIN",
 		NetworkState: ns,
 		Details: map[string]string{
-			"name": containerInspect.Name,
-			"id":   containerInspect.ID,
-			"port": fmt.Sprintf("%d", ofPort),
-			"mac":  macAddress,
-			"ip":   hostIP,
+			"name":         containerInspect.Name,
+			"id":           containerInspect.ID,
+			"port":         fmt.Sprintf("%d", ofPort),
+			"mac":          macAddress,
+			"ip":           hostIP,
+			"ipv6":         containerNetSettings.GlobalIPv6Address,
+			"vlan":         fmt.Sprintf("%d", vlan),
+			"tagged_vlans": formatVLANs(taggedVlans),
+			"ingress_rate": fmt.Sprintf("%d", rateLimits.IngressKbps),
+			"egress_rate":  fmt.Sprintf("%d", rateLimits.EgressKbps),
 		},
 	}
 }
 
-func mustHandleLeaveContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+// mustProgramPortMaps DNATs docker's port bindings for a joined endpoint, replacing any existing port maps.
+func mustProgramPortMaps(d *Driver, endpointID string, options map[string]interface{}, OFPorts *map[string]OFPortContainer) []PortMap {
+	containerMap := (*OFPorts)[endpointID]
+	ns := d.networks[containerMap.NetworkID]
+	mustRevokePortMaps(d, endpointID, OFPorts)
+	containerMap = (*OFPorts)[endpointID]
+
+	// Regular docker uses docker proxy, to listen on the configured port and proxy them into the container.
+	// dovesnap doesn't get to use docker proxy, so we listen on the configured port on the network's gateway instead.
+	containerNetSettings := containerMap.containerInspect.NetworkSettings.Networks[ns.NetworkName]
+	inUse := []PortMap{}
+	for _, otherMap := range *OFPorts {
+		inUse = append(inUse, otherMap.portMaps...)
+	}
+	portMaps := []PortMap{}
+	for _, pm := range mustGetPortMaps(options, containerNetSettings) {
+		pm = mustAllocatePortMap(pm, inUse)
+		log.Infof("adding portmap %s for %s", pm, containerMap.containerInspect.Name)
+		d.firewall.mustAddPortMap(ns.BridgeName, pm)
+		inUse = append(inUse, pm)
+		portMaps = append(portMaps, pm)
+		containerMap.portMaps = portMaps
+		(*OFPorts)[endpointID] = containerMap
+	}
+	return portMaps
+}
+
+func mustRevokePortMaps(d *Driver, endpointID string, OFPorts *map[string]OFPortContainer) {
+	containerMap := (*OFPorts)[endpointID]
+	ns := d.networks[containerMap.NetworkID]
+	for _, pm := range containerMap.portMaps {
+		log.Infof("removing portmap %s for %s", pm, containerMap.containerInspect.Name)
+		d.firewall.mustDeletePortMap(ns.BridgeName, pm)
+	}
+	containerMap.portMaps = nil
+	(*OFPorts)[endpointID] = containerMap
+}
+
+func mustHandleExternalConnectivity(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	reply := DovesnapOpReply{}
+
 	defer func() {
 		if rerr := recover(); rerr != nil {
-			log.Errorf("mustHandleLeaveContainer failed: %v", rerr)
+			log.Errorf("mustHandleExternalConnectivity failed: %v", rerr)
+			reply.Err = fmt.Errorf("cannot %s external connectivity: %v", opMsg.Operation, rerr)
 		}
-		opMsg.Reply <- DovesnapOpReply{}
+		opMsg.Reply <- reply
 	}()
 
 	containerMap, ok := (*OFPorts)[opMsg.EndpointID]
-	if !ok {
+	if !ok || containerMap.state != endpointJoined {
 		panic(fmt.Errorf("endpoint %s was not Join()d", opMsg.EndpointID))
 	}
-
-	udhcpcCmd := containerMap.udhcpcCmd
-	if udhcpcCmd != nil {
-		log.Infof("Shutting down udhcpc")
-		udhcpcCmd.Process.Kill()
-		udhcpcCmd.Wait()
+	ns := d.networks[containerMap.NetworkID]
+	portMaps := []PortMap{}
+	if opMsg.Operation == "programexternal" {
+		portMaps = mustProgramPortMaps(d, opMsg.EndpointID, opMsg.Options, OFPorts)
+	} else {
+		mustRevokePortMaps(d, opMsg.EndpointID, OFPorts)
 	}
+	containerState := ns.DynamicNetworkStates.Containers[opMsg.EndpointID]
+	containerState.PortMaps = portMaps
+	ns.DynamicNetworkStates.Containers[opMsg.EndpointID] = containerState
+}
 
-	portID := fmt.Sprintf(ovsPortPrefix + truncateID(opMsg.EndpointID))
-	ofPort := d.ovsdber.mustGetOfPort(portID)
-	// Must delete veth for the endpoint here - DeleteEndpoint happens before leave container,
-	// so we must the delete here to be able to remove the port sucessfully.
-	localVethPair := vethPair(truncateID(opMsg.EndpointID))
-	delVethPair(localVethPair)
+// mustLeaveContainer undoes Join(), returning the endpoint to the reserved state.
+func mustLeaveContainer(d *Driver, endpointID string, OFPorts *map[string]OFPortContainer) {
+	containerMap := (*OFPorts)[endpointID]
+	ns := d.networks[containerMap.NetworkID]
+	ofPort := containerMap.OFPort
 
-	ns := d.networks[opMsg.NetworkID]
-	d.ovsdber.mustDeletePort(ns.BridgeName, portID)
-	d.faucetconfrpcer.mustDeleteDpInterface(ns.NetworkName, ofPort)
+	// Whatever happens below, the endpoint is no longer joined, but FAUCET may still have its interface
+	// until that is deleted.
+	(*OFPorts)[endpointID] = OFPortContainer{
+		OFPort:    ofPort,
+		NetworkID: containerMap.NetworkID,
+		state:     endpointJoining,
+	}
+	containerState, joined := ns.DynamicNetworkStates.Containers[endpointID]
+	if s, ok := d.dhcpServers[containerMap.NetworkID]; ok && joined {
+		s.unreserve(mustParseMAC(containerState.MacAddress))
+	}
+	delete(ns.DynamicNetworkStates.Containers, endpointID)
+	d.updateDNS(containerMap.NetworkID)
 
-	containerNetSettings := containerMap.containerInspect.NetworkSettings.Networks[ns.NetworkName]
-	hostIP := containerNetSettings.IPAddress
-	gatewayIP := containerNetSettings.Gateway
-	for _, portMapRaw := range containerMap.Options[portMapOption].([]interface{}) {
-		hostPort, port, ipProto := mustGetPortMap(portMapRaw)
-		mustDeleteGatewayPortMap(ns.BridgeName, ipProto, gatewayIP, hostIP, hostPort, port)
+	if containerMap.dhcpClient != nil {
+		containerMap.dhcpClient.stop()
 	}
 
-	delete(*OFPorts, opMsg.EndpointID)
-	delete(ns.DynamicNetworkStates.Containers, opMsg.EndpointID)
-	deleteNsLink(containerMap.containerInspect.ID)
+	for _, pm := range containerMap.portMaps {
+		d.firewall.mustDeletePortMap(ns.BridgeName, pm)
+	}
+
+	d.faucetconfrpcer.mustDeleteDpInterface(ns.NetworkName, ofPort)
+	(*OFPorts)[endpointID] = OFPortContainer{
+		OFPort:    ofPort,
+		NetworkID: containerMap.NetworkID,
+		state:     endpointReserved,
+	}
+	d.clearRateLimits(vethPair(truncateID(endpointID)).Name, containerState.RateLimits)
+	for _, acl := range []string{containerState.PortSecurityAcl, containerState.PolicyAcl, containerState.InlineAcl} {
+		if acl != "" {
+			d.deleteFaucetAcl(acl)
+		}
+	}
+	compilePolicies(d, containerMap.NetworkID)
 
 	d.notifyMsgChan <- NotifyMsg{
 		Type:         "CONTAINER",
@@ -899,31 +1321,90 @@ func mustHandleLeaveContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]O
 	}
 }
 
-func reconcileDhcpIp(d *Driver) {
-	stat, err := os.Stat(fmt.Sprintf("%s/udhcpc.updated", dhcpStatePath))
-	if err != nil {
-		return
+func mustHandleLeaveContainer(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleLeaveContainer failed: %v", rerr)
+		}
+		opMsg.Reply <- DovesnapOpReply{}
+	}()
+
+	containerMap, ok := (*OFPorts)[opMsg.EndpointID]
+	if !ok || containerMap.state != endpointJoined {
+		panic(fmt.Errorf("endpoint %s was not Join()d", opMsg.EndpointID))
 	}
-	mtime := stat.ModTime()
-	if mtime == d.lastDhcpMtime {
-		return
+	mustLeaveContainer(d, opMsg.EndpointID, OFPorts)
+}
+
+// mustHandleDeleteEndpoint removes everything CreateEndpoint() and Join() added, whatever state the
+// endpoint was left in (including endpoints dovesnap has no state for, e.g. after a restart).
+func mustHandleDeleteEndpoint(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleDeleteEndpoint failed: %v", rerr)
+		}
+		opMsg.Reply <- DovesnapOpReply{}
+	}()
+
+	ns := d.networks[opMsg.NetworkID]
+	containerMap, ok := (*OFPorts)[opMsg.EndpointID]
+	if ok && containerMap.state == endpointJoined {
+		log.Warnf("endpoint %s deleted before Leave()", opMsg.EndpointID)
+		func() {
+			// Remove the port and veth below, even if leaving fails.
+			defer func() {
+				if rerr := recover(); rerr != nil {
+					log.Errorf("cannot leave endpoint %s: %v", opMsg.EndpointID, rerr)
+				}
+			}()
+			mustLeaveContainer(d, opMsg.EndpointID, OFPorts)
+		}()
+		containerMap = (*OFPorts)[opMsg.EndpointID]
 	}
-	d.lastDhcpMtime = mtime
-	for _, ns := range d.networks {
-		if !ns.UseDHCP {
-			continue
+	delete(*OFPorts, opMsg.EndpointID)
+
+	localVethPair := vethPair(truncateID(opMsg.EndpointID))
+	portID := localVethPair.Name
+	ofPort := containerMap.OFPort
+	if !ok {
+		ofPort, _ = d.ovsdber.getOfPort(portID)
+	}
+	if _, err := VsCtl("--if-exists", "del-port", ns.BridgeName, portID); err != nil {
+		log.Warnf("cannot delete OVS port %s: %v", portID, err)
+	}
+	if !ok || containerMap.state == endpointJoining {
+		d.ovsdber.clearRateLimits(portID)
+	}
+	if err := netlink.LinkDel(localVethPair); err != nil {
+		log.Debugf("veth %s already deleted: %v", portID, err)
+	}
+	if ofPort != 0 && (!ok || containerMap.state == endpointJoining) {
+		// Join() may have failed after configuring FAUCET, or dovesnap may have restarted.
+		if err := d.faucetconfrpcer.deleteDpInterface(ns.NetworkName, ofPort); err != nil {
+			log.Debugf("no FAUCET interface %d on %s: %v", ofPort, ns.NetworkName, err)
 		}
-		for containerid, container := range ns.DynamicNetworkStates.Containers {
-			ipFile := fmt.Sprintf("%s/%s-ipv4.txt", dhcpStatePath, container.Id)
-			content, err := ioutil.ReadFile(ipFile)
-			if err != nil {
-				continue
+	}
+	if ok && containerMap.state == endpointJoining {
+		// Remove what a failed Join() may have added to FAUCET, once the interface no longer uses it.
+		if ns.Userspace {
+			d.clearRateLimits(portID, RateLimits{Meter: rateMeterName(portID)})
+		}
+		for _, acl := range []string{portSecurityAclName(opMsg.EndpointID), policyAclName(opMsg.EndpointID), containerInlineAclName(opMsg.EndpointID)} {
+			if _, set := d.faucetAcls[acl]; set {
+				d.deleteFaucetAcl(acl)
 			}
-			container.HostIP = strings.Trim(string(content), " \n")
-			ns.DynamicNetworkStates.Containers[containerid] = container
-			log.Infof("HostIP for %s updated: %s", container.Id, container.HostIP)
 		}
 	}
+
+	d.notifyMsgChan <- NotifyMsg{
+		Type:         "ENDPOINT",
+		Operation:    "DELETE",
+		NetworkState: ns,
+		Details: map[string]string{
+			"id":   opMsg.EndpointID,
+			"port": fmt.Sprintf("%d", ofPort),
+		},
+	}
 }
 
 func reconcileOvs(d *Driver, allPortDesc *map[string]map[OFPortType]string) {
@@ -1059,24 +1540,47 @@ func (d *Driver) resourceManager() {
 				mustHandleJoinContainer(d, opMsg, &OFPorts)
 			case "leave":
 				mustHandleLeaveContainer(d, opMsg, &OFPorts)
+			case "deleteendpoint":
+				mustHandleDeleteEndpoint(d, opMsg, &OFPorts)
+			case "programexternal", "revokeexternal":
+				mustHandleExternalConnectivity(d, opMsg, &OFPorts)
+			case "endpointinfo":
+				mustHandleEndpointInfo(d, opMsg, &OFPorts)
 			case "reserveport":
 				mustHandleReservePort(d, opMsg, &OFPorts)
 			case "getnetwork":
 				mustHandleGetNetwork(d, opMsg)
+			case "gc":
+				collectGarbage(d, &OFPorts)
+			case "reconcilefirewall":
+				reconcileFirewall(d, &OFPorts, true)
+			case "dhcplease", "dhcpfailed", "dhcprestarted":
+				mustHandleDhcpClient(d, opMsg, &OFPorts)
+			case "overrideportacl", "overridemirror":
+				mustHandleOverride(d, opMsg, &OFPorts)
+			case "quarantine", "release":
+				mustHandleQuarantine(d, opMsg, &OFPorts)
+			case "setpolicies", "deletepolicy", "policies":
+				mustHandlePolicies(d, opMsg)
 			case "networks":
 				reconcileOvs(d, &AllPortDesc)
-				reconcileDhcpIp(d)
+				reconcileDhcpLeases(d)
 				mustHandleNetworks(d, opMsg)
 			case "quit":
 				log.Infof("processed quit")
 				return
 			default:
-				log.Errorf("Unknown resource manager message: %s", opMsg)
+				log.Errorf("Unknown resource manager message: %v", opMsg)
 			}
 			log.Debugf("resourceManager() completed serial %d, %+v", serial, opMsg)
 		case <-time.After(time.Second * 3):
 			reconcileOvs(d, &AllPortDesc)
-			reconcileDhcpIp(d)
+			reconcileFirewall(d, &OFPorts, false)
+			if gcDue(d) {
+				collectGarbage(d, &OFPorts)
+			}
+			reloadPolicyDir(d)
+			reconcileDhcpServerAddresses(d)
 		}
 	}
 }
@@ -1107,7 +1611,7 @@ func (d *Driver) notifier() {
 				panic(err)
 			}
 			// TODO: emit to UDS
-			log.Infof(fmt.Sprintf("%s", encodedMsg))
+			log.Infof("%s", encodedMsg)
 		}
 	}
 }
@@ -1138,7 +1642,7 @@ func (d *Driver) restoreNetworks() {
 		}
 		// We need to recover from two different scenarios where OVS may be in a bad state.
 		if d.ovsdber.ifUp(ns.BridgeName) {
-			_, err := getIfaceAddr(ns.BridgeName)
+			_, err := getIfaceAddr(ns.BridgeName, ipFamily(ns.Gateway))
 			/// OVS config seems to be in place, bridge is up, but it is missing its IP config.
 			if err != nil {
 				log.Errorf("Bridge interface %s exists but IP address is missing, recreating network", ns.BridgeName)
@@ -1149,6 +1653,12 @@ func (d *Driver) restoreNetworks() {
 			log.Errorf("Bridge interface %s exists but is down, recreating network", ns.BridgeName)
 			createMsg.Operation = "recreatedownbridge"
 		}
+		if createMsg.Operation == "create" {
+			// Policy routing does not survive a host reboot, even if OVS' bridge does.
+			if err := addPolicyRouting(ns); err != nil {
+				log.Errorf("Could not restore policy routing for bridge %s because %v", ns.BridgeName, err)
+			}
+		}
 		d.createDeleteNetworkWG.Add(1)
 		d.dovesnapOpChan <- createMsg
 	}
@@ -1162,13 +1672,13 @@ func (d *Driver) getWebResponse(w http.ResponseWriter, operation string) {
 	}
 	d.dovesnapOpChan <- requestMsg
 	reply := <-requestMsg.Reply
-	fmt.Fprintf(w, reply.NetworkStateString)
+	fmt.Fprint(w, reply.NetworkStateString)
 }
 
 func (d *Driver) handleNetworksWeb(w http.ResponseWriter, r *http.Request) {
 	remoteIP := getRemoteIp(r)
 	authIP := isAuthIP(remoteIP, d.authIPs)
-	log.Debugf(fmt.Sprintf("web request from %s, authorized %v", remoteIP, authIP))
+	log.Debugf("web request from %s, authorized %v", remoteIP, authIP)
 	if authIP {
 		d.getWebResponse(w, "networks")
 	} else {
@@ -1178,6 +1688,19 @@ func (d *Driver) handleNetworksWeb(w http.ResponseWriter, r *http.Request) {
 
 func (d *Driver) runWeb(port int) {
 	http.HandleFunc("/networks", d.handleNetworksWeb)
+	http.HandleFunc("/containers/portacl", func(w http.ResponseWriter, r *http.Request) {
+		d.handleOverrideWeb(w, r, "overrideportacl", "acls")
+	})
+	http.HandleFunc("/containers/mirror", func(w http.ResponseWriter, r *http.Request) {
+		d.handleOverrideWeb(w, r, "overridemirror", "mirror")
+	})
+	http.HandleFunc("/policies", d.handlePoliciesWeb)
+	http.HandleFunc("/containers/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		d.handleQuarantineWeb(w, r, "quarantine")
+	})
+	http.HandleFunc("/containers/release", func(w http.ResponseWriter, r *http.Request) {
+		d.handleQuarantineWeb(w, r, "release")
+	})
 
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
 		panic(err)
@@ -1192,9 +1715,9 @@ func (d *Driver) Quit() {
 	d.resourceManagerWG.Wait()
 }
 
-func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName string, flagFaucetconfrpcServerPort int, flagFaucetconfrpcKeydir string, flagFaucetconfrpcConnRetries int, flagStackPriority1 string, flagStackingInterfaces string, flagStackMirrorInterface string, flagDefaultControllers string, flagMirrorBridgeIn string, flagMirrorBridgeOut string, flagStatusServerPort int, flagStatusAuthIPs string) *Driver {
+func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName string, flagFaucetconfrpcServerPort int, flagFaucetconfrpcKeydir string, flagFaucetconfrpcConnRetries int, flagStackPriority1 string, flagStackingInterfaces string, flagStackMirrorInterface string, flagDefaultControllers string, flagMirrorBridgeIn string, flagMirrorBridgeOut string, flagStatusServerPort int, flagStatusAuthIPs string, flagGCInterval int, flagFirewall string, flagQuarantineAcl string, flagQuarantineVlan string, flagPolicyDir string) *Driver {
 	log.Infof("Initializing dovesnap")
-	ensureDirExists(netNsPath)
+	ensureDirExists(dovesnapStatePath)
 
 	stack_mirror_interface := strings.Split(flagStackMirrorInterface, ":")
 	if len(flagStackMirrorInterface) > 0 && len(stack_mirror_interface) != 2 {
@@ -1213,7 +1736,19 @@ func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName s
 		stackDefaultControllers: flagDefaultControllers,
 		mirrorBridgeIn:          flagMirrorBridgeIn,
 		mirrorBridgeOut:         flagMirrorBridgeOut,
-		lastDhcpMtime:           time.Unix(0, 0),
+		lastGC:                  time.Unix(0, 0),
+		gcInterval:              time.Duration(flagGCInterval) * time.Second,
+		gcSuspects:              make(map[string]bool),
+		raServers:               make(map[string]*raServer),
+		dhcpServers:             make(map[string]*dhcpServer),
+		dnsServers:              make(map[string]*dnsServer),
+		containerOverrides:      loadContainerOverrides(),
+		quarantineAcl:           flagQuarantineAcl,
+		policyDir:               flagPolicyDir,
+		dirPolicies:             make(map[string]NetworkPolicy),
+		apiPolicies:             loadApiPolicies(),
+		faucetAcls:              make(map[string]string),
+		portSecurityRules:       make(map[string]int),
 		networks:                make(map[string]NetworkState),
 		stackMirrorConfigs:      make(map[string]StackMirrorConfig),
 		dovesnapOpChan:          make(chan DovesnapOp, chanSize),
@@ -1228,8 +1763,13 @@ func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName s
 		d.authIPs = append(d.authIPs, *ipnet)
 	}
 
+	if flagQuarantineVlan != "" {
+		d.quarantineVlan = mustParseVLAN(flagQuarantineVlan)
+	}
+
 	d.dockerer.mustGetDockerClient()
 	d.shortEngineId = d.dockerer.mustGetShortEngineID()
+	d.firewall = mustGetFirewaller(flagFirewall)
 	d.mirrorBridgeName = d.mustGetMirrorBrName()
 	d.loopbackBridgeName = d.mustGetLoopbackBrName()
 	d.stackDpName = d.mustGetStackDPName()
@@ -1239,6 +1779,7 @@ func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName s
 		flagFaucetconfrpcServerPort,
 		flagFaucetconfrpcKeydir,
 		flagFaucetconfrpcConnRetries)
+	d.faucetconfrpcer.mustSetFaucetConfigFile(d.faucetconfrpcer.allowAllAclYaml())
 
 	d.ovsdber.waitForOvs()
 
@@ -1263,11 +1804,19 @@ func NewDriver(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName s
 		log.Warnf("No stacking interface defined, not stacking DPs or creating a stacking bridge")
 	}
 
+	reloadPolicyDir(d)
+
 	d.resourceManagerWG.Add(1)
 	go d.resourceManager()
 
 	d.restoreNetworks()
 
+	// Rebuild NAT rules for restored networks, replacing any stale rules.
+	d.dovesnapOpChan <- DovesnapOp{Operation: "reconcilefirewall"}
+
+	// Look for resources leaked while dovesnap was not running.
+	d.dovesnapOpChan <- DovesnapOp{Operation: "gc"}
+
 	go d.runWeb(flagStatusServerPort)
 
 	return d
@@ -0,0 +1,152 @@
+package ovs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	inlineAclPrefix  = "dovesnap-acl-"
+	inlineNATAcl     = "nat"
+	inlineDefaultAcl = "default"
+	inlineVLANOutAcl = "vlan-out"
+)
+
+// dovesnapAclPrefixes are the prefixes of ACLs dovesnap creates in FAUCET (and may garbage collect).
+var dovesnapAclPrefixes = []string{inlineAclPrefix, policyAclPrefix, portSecurityAclPrefix}
+
+// mustParseAclRules parses FAUCET ACL rules (a list of {rule: {...}}), from a YAML or JSON file (if an absolute path)
+// or base64 encoded YAML or JSON, and returns them as a YAML flow sequence.
+func mustParseAclRules(rulesStr string) string {
+	var rulesBytes []byte
+	var err error
+	if strings.HasPrefix(rulesStr, "/") {
+		rulesBytes, err = os.ReadFile(rulesStr)
+		if err != nil {
+			panic(fmt.Errorf("cannot read ACL rules: %v", err))
+		}
+	} else {
+		rulesBytes, err = base64.StdEncoding.DecodeString(rulesStr)
+		if err != nil {
+			rulesBytes, err = base64.URLEncoding.DecodeString(rulesStr)
+		}
+		if err != nil {
+			panic(fmt.Errorf("ACL rules must be a file or base64 encoded: %v", err))
+		}
+	}
+	rules := []map[string]interface{}{}
+	if err := yaml.Unmarshal(rulesBytes, &rules); err != nil {
+		panic(fmt.Errorf("cannot parse ACL rules: %v", err))
+	}
+	if len(rules) == 0 {
+		panic(fmt.Errorf("ACL rules must not be empty"))
+	}
+	for i, rule := range rules {
+		if _, ok := rule["rule"].(map[string]interface{}); !ok || len(rule) != 1 {
+			panic(fmt.Errorf("ACL rule %d must be a single rule: {...}", i+1))
+		}
+	}
+	// JSON is YAML, and unlike YAML flow style from yaml.v3, is never split across lines.
+	rulesJson, err := json.Marshal(rules)
+	if err != nil {
+		panic(fmt.Errorf("cannot encode ACL rules: %v", err))
+	}
+	return string(rulesJson)
+}
+
+func networkInlineAclName(ns NetworkState, kind string) string {
+	return inlineAclPrefix + ns.BridgeName + "-" + kind
+}
+
+func containerInlineAclName(endpointID string) string {
+	return inlineAclPrefix + vethPair(truncateID(endpointID)).Name
+}
+
+// getNetworkInlineAclRules returns a network's inline ACL rules option of a kind.
+func getNetworkInlineAclRules(ns NetworkState, kind string) string {
+	switch kind {
+	case inlineNATAcl:
+		return ns.NATAclRules
+	case inlineDefaultAcl:
+		return ns.DefaultAclRules
+	case inlineVLANOutAcl:
+		return ns.VLANOutAclRules
+	}
+	return ""
+}
+
+// getNetworkAcls returns a network's inline ACL of a kind (if defined), followed by the named ACLs.
+func getNetworkAcls(ns NetworkState, kind string, namedAcls string) string {
+	acls := []string{}
+	if getNetworkInlineAclRules(ns, kind) != "" {
+		acls = append(acls, networkInlineAclName(ns, kind))
+	}
+	if namedAcls != "" {
+		acls = append(acls, namedAcls)
+	}
+	return strings.Join(acls, ", ")
+}
+
+// getNetworkInlineAcls returns the names of a network's inline ACLs.
+func getNetworkInlineAcls(ns NetworkState) []string {
+	acls := []string{}
+	for _, kind := range []string{inlineNATAcl, inlineDefaultAcl, inlineVLANOutAcl} {
+		if getNetworkInlineAclRules(ns, kind) != "" {
+			acls = append(acls, networkInlineAclName(ns, kind))
+		}
+	}
+	return acls
+}
+
+// mustSetInlineAcl sets (if changed) an inline ACL in FAUCET, and returns its name.
+func (d *Driver) mustSetInlineAcl(aclName string, rulesStr string) string {
+	aclYaml := fmt.Sprintf("%s: %s", aclName, mustParseAclRules(rulesStr))
+	if d.faucetAcls[aclName] != aclYaml {
+		d.faucetconfrpcer.mustSetFaucetConfigFile(fmt.Sprintf("{acls: {%s}}", aclYaml))
+		d.faucetAcls[aclName] = aclYaml
+		log.Infof("Set inline ACL %s", aclName)
+	}
+	return aclName
+}
+
+// mustSetNetworkInlineAcls sets a network's inline ACLs in FAUCET.
+func (d *Driver) mustSetNetworkInlineAcls(ns NetworkState) {
+	for _, kind := range []string{inlineNATAcl, inlineDefaultAcl, inlineVLANOutAcl} {
+		if rulesStr := getNetworkInlineAclRules(ns, kind); rulesStr != "" {
+			d.mustSetInlineAcl(networkInlineAclName(ns, kind), rulesStr)
+		}
+	}
+}
+
+// getOwnedAcls returns the ACLs dovesnap's networks and containers use.
+func (d *Driver) getOwnedAcls() map[string]bool {
+	owned := make(map[string]bool)
+	for _, ns := range d.networks {
+		for _, acl := range getNetworkInlineAcls(ns) {
+			owned[acl] = true
+		}
+		for _, containerState := range ns.DynamicNetworkStates.Containers {
+			for _, acl := range []string{containerState.InlineAcl, containerState.PortSecurityAcl, containerState.PolicyAcl} {
+				if acl != "" {
+					owned[acl] = true
+				}
+			}
+		}
+	}
+	return owned
+}
+
+func isDovesnapAcl(aclName string) bool {
+	for _, prefix := range dovesnapAclPrefixes {
+		if strings.HasPrefix(aclName, prefix) {
+			return true
+		}
+	}
+	return false
+}
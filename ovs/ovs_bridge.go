@@ -7,6 +7,7 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
 func (ovsdber *ovsdber) show() (string, error) {
@@ -215,25 +216,36 @@ func (d *Driver) initBridge(ns NetworkState, controller string, dpid string, add
 		return err
 	}
 	if ns.Mode == modeNAT || ns.Mode == modeRouted {
-		gatewayIP := ns.Gateway + "/" + ns.GatewayMask
-		if err := setInterfaceIP(bridgeName, gatewayIP); err != nil {
-			log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, bridgeName, err)
-		}
+		for _, gatewayIP := range getGatewayCidrs(ns) {
+			if err := setInterfaceIP(bridgeName, gatewayIP); err != nil {
+				log.Debugf("Error assigning address: %s on bridge: %s with an error of: %s", gatewayIP, bridgeName, err)
+			}
 
-		// Validate that the IPAddress is there!
-		_, err := getIfaceAddr(bridgeName)
-		if err != nil {
-			log.Fatalf("No IP address found on bridge %s", bridgeName)
-			return err
+			// Validate that the IPAddress is there!
+			_, err := getIfaceAddr(bridgeName, ipFamily(gatewayIP))
+			if err != nil {
+				log.Fatalf("No IP address found on bridge %s", bridgeName)
+				return err
+			}
+
+			if ipFamily(gatewayIP) == netlink.FAMILY_V6 {
+				if err := enableIPv6Forwarding(ns.FlatBindInterface); err != nil {
+					log.Warnf("Could not enable IPv6 forwarding for bridge %s because %v", bridgeName, err)
+				}
+			}
 		}
 
-		// Add NAT rules for iptables
-		if ns.Mode == modeNAT {
-			if err = natOut(gatewayIP, "-I"); err != nil {
+		// Add NAT and forwarding rules
+		for _, eg := range getEgressConfigs(ns) {
+			if err := d.firewall.egress(eg, true); err != nil {
 				log.Fatalf("Could not set NAT rules for bridge %s because %v", bridgeName, err)
 				return err
 			}
 		}
+		if err := addPolicyRouting(ns); err != nil {
+			log.Errorf("Could not set policy routing for bridge %s because %v", bridgeName, err)
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,553 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	artifactBridge    = "bridge"
+	artifactOvsPort   = "ovsport"
+	artifactVeth      = "veth"
+	artifactPatch     = "patch"
+	artifactNetNs     = "netns"
+	artifactIptables  = "iptables"
+	artifactNftables  = "nftables"
+	artifactFaucetDp  = "faucetdp"
+	dovesnapDpDescPfx = "OVS Bridge " + bridgePrefix
+	stackDpDescPfx    = "Dovesnap Stacking Bridge"
+)
+
+// dovesnapArtifact is a host resource dovesnap may have created.
+type dovesnapArtifact struct {
+	Kind   string
+	Name   string
+	Detail string
+	Orphan bool
+	remove func()
+}
+
+// liveArtifacts is what dovesnap should currently own, derived from docker.
+type liveArtifacts struct {
+	bridges      map[string]bool
+	endpoints    map[string]bool
+	containerIDs map[string]bool
+	hostIPs      map[string]bool
+	dpNames      map[string]bool
+	patches      map[string]bool
+	subnets      []*net.IPNet
+	otherSubnets []*net.IPNet
+}
+
+type Cleaner struct {
+	dockerer
+	faucetconfrpcer
+	ovsdber
+	shortEngineId      string
+	mirrorBridgeName   string
+	loopbackBridgeName string
+	stackDpName        string
+}
+
+func makeLiveArtifacts() liveArtifacts {
+	return liveArtifacts{
+		bridges:      make(map[string]bool),
+		endpoints:    make(map[string]bool),
+		containerIDs: make(map[string]bool),
+		hostIPs:      make(map[string]bool),
+		dpNames:      make(map[string]bool),
+		patches:      make(map[string]bool),
+	}
+}
+
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRuleIP returns the IP from an iptables address argument (a.b.c.d/32 or a.b.c.d:port).
+func parseRuleIP(addr string) net.IP {
+	addr = strings.Split(addr, "/")[0]
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+func ruleArg(args []string, flag string) string {
+	for i, arg := range args {
+		if arg == flag && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func hostHasIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cleaner) infraBridges() []string {
+	return []string{c.mirrorBridgeName, c.loopbackBridgeName, c.stackDpName}
+}
+
+func (c *Cleaner) isInfraBridge(bridgeName string) bool {
+	for _, infraBridge := range c.infraBridges() {
+		if bridgeName == infraBridge {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cleaner) isDovesnapBridge(bridgeName string) bool {
+	return strings.HasPrefix(bridgeName, ovsDovesnapPrefix) || c.isInfraBridge(bridgeName)
+}
+
+// mustGetLiveArtifacts inventories what docker says dovesnap should currently own.
+func (c *Cleaner) mustGetLiveArtifacts() liveArtifacts {
+	live := makeLiveArtifacts()
+	for _, infraBridge := range c.infraBridges() {
+		live.bridges[infraBridge] = true
+	}
+	live.dpNames[c.stackDpName] = true
+	for _, netSummary := range c.dockerer.mustGetAllNetworks() {
+		for _, config := range netSummary.IPAM.Config {
+			_, subnet, err := net.ParseCIDR(config.Subnet)
+			if err != nil {
+				continue
+			}
+			if netSummary.Driver == DriverName {
+				live.subnets = append(live.subnets, subnet)
+			} else {
+				live.otherSubnets = append(live.otherSubnets, subnet)
+			}
+		}
+		if netSummary.Driver != DriverName {
+			continue
+		}
+		netInspect := c.dockerer.mustGetNetworkInspectFromID(netSummary.ID)
+		bridgeName := getStrOptionFromResource(&netInspect, bridgeNameOption, mustGetBridgeNameFromResource(&netInspect))
+		live.bridges[bridgeName] = true
+		live.dpNames[netInspect.Name] = true
+		for _, infraBridge := range c.infraBridges() {
+			live.patches[patchName(bridgeName, infraBridge)] = true
+			live.patches[patchName(infraBridge, bridgeName)] = true
+		}
+		for containerID, endpoint := range netInspect.Containers {
+			live.endpoints[truncateID(endpoint.EndpointID)] = true
+			live.containerIDs[containerID] = true
+			if ip := parseRuleIP(endpoint.IPv4Address); ip != nil {
+				live.hostIPs[ip.String()] = true
+			}
+		}
+	}
+	return live
+}
+
+func (c *Cleaner) ovsArtifacts(live liveArtifacts) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	output, err := VsCtl("list-br")
+	if err != nil {
+		log.Warnf("cannot list OVS bridges: %v", err)
+		return artifacts
+	}
+	for _, bridgeName := range strings.Fields(output) {
+		if !c.isDovesnapBridge(bridgeName) {
+			continue
+		}
+		artifacts = append(artifacts, dovesnapArtifact{
+			Kind:   artifactBridge,
+			Name:   bridgeName,
+			Orphan: !live.bridges[bridgeName],
+			remove: func() { c.ovsdber.mustDeleteBridge(bridgeName) },
+		})
+		ports, err := VsCtl("list-ports", bridgeName)
+		if err != nil {
+			continue
+		}
+		for _, portName := range strings.Fields(ports) {
+			orphan := false
+			kind := artifactOvsPort
+			if strings.HasPrefix(portName, ovsPortPrefix) {
+				orphan = !live.endpoints[strings.TrimPrefix(portName, ovsPortPrefix)]
+			} else if strings.HasPrefix(portName, patchPrefix) && c.isInfraBridge(bridgeName) {
+				kind = artifactPatch
+				orphan = !live.patches[portName]
+			} else {
+				continue
+			}
+			artifacts = append(artifacts, dovesnapArtifact{
+				Kind:   kind,
+				Name:   portName,
+				Detail: bridgeName,
+				Orphan: orphan || !live.bridges[bridgeName],
+				remove: func() { VsCtl("--if-exists", "del-port", bridgeName, portName) },
+			})
+		}
+	}
+	return artifacts
+}
+
+func (c *Cleaner) linkArtifacts(live liveArtifacts, ovsPorts map[string]dovesnapArtifact) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Warnf("cannot list links: %v", err)
+		return artifacts
+	}
+	for _, link := range links {
+		if link.Type() != "veth" {
+			continue
+		}
+		linkName := link.Attrs().Name
+		orphan := false
+		kind := artifactVeth
+		if strings.HasPrefix(linkName, ovsPortPrefix) {
+			orphan = !live.endpoints[strings.TrimPrefix(linkName, ovsPortPrefix)]
+		} else if strings.HasPrefix(linkName, peerOvsPortPrefix) {
+			orphan = !live.endpoints[strings.TrimPrefix(linkName, peerOvsPortPrefix)]
+		} else if patch, ok := ovsPorts[linkName]; ok && patch.Kind == artifactPatch {
+			kind = artifactPatch
+			orphan = patch.Orphan
+		} else {
+			continue
+		}
+		artifacts = append(artifacts, dovesnapArtifact{
+			Kind:   kind,
+			Name:   linkName,
+			Detail: "link",
+			Orphan: orphan,
+			remove: func() { netlink.LinkDel(link) },
+		})
+	}
+	return artifacts
+}
+
+func (c *Cleaner) netNsArtifacts(live liveArtifacts) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	for id, target := range getNsLinks() {
+		// /var/run/netns is shared with other tools, so only a link for a dovesnap container, or a dangling link
+		// named after a container (as earlier versions of dovesnap made), is dovesnap's.
+		stale := nsLinkStale(target)
+		if !stale && !live.containerIDs[id] {
+			continue
+		}
+		nsLink := filepath.Join(netNsPath, id)
+		artifacts = append(artifacts, dovesnapArtifact{
+			Kind:   artifactNetNs,
+			Name:   nsLink,
+			Detail: target,
+			Orphan: stale,
+			remove: func() { os.Remove(nsLink) },
+		})
+	}
+	return artifacts
+}
+
+// classifyNatRule decides if an iptables nat rule looks like one dovesnap made, and whether it is orphaned.
+func classifyNatRule(args []string, live liveArtifacts) (bool, bool) {
+	chain := args[1]
+	target := ruleArg(args, "-j")
+	if chain == dovesnapNatChain && ruleArg(args, "--dport") == "" {
+		// egressRules(), possibly pinned to an interface.
+		ip := parseRuleIP(ruleArg(args, "-s"))
+		return true, ip == nil || !subnetsContain(live.subnets, ip)
+	}
+	if chain == dovesnapNatChain {
+		chain = "POSTROUTING"
+	}
+	if ruleArg(args, "-i") != "" || ruleArg(args, "-o") != "" {
+		return false, false
+	}
+	switch {
+	case chain == "POSTROUTING" && target == "MASQUERADE" && len(args) == 6:
+		// Masquerade from older versions of dovesnap.
+		ip := parseRuleIP(ruleArg(args, "-s"))
+		if ip == nil || subnetsContain(live.otherSubnets, ip) {
+			return false, false
+		}
+		return true, !subnetsContain(live.subnets, ip)
+	case chain == "POSTROUTING" && target == "MASQUERADE" && ruleArg(args, "--dport") != "":
+		// portMapRules() hairpin masquerade.
+		ip := parseRuleIP(ruleArg(args, "-s"))
+		if ip == nil || subnetsContain(live.otherSubnets, ip) {
+			return false, false
+		}
+		if subnetsContain(live.subnets, ip) {
+			return true, !live.hostIPs[ip.String()]
+		}
+		return true, true
+	case (chain == "DOCKER" || chain == "OUTPUT" || chain == dovesnapDnatChain) && target == "DNAT":
+		// portMapRules() DNAT via the network gateway.
+		ip := parseRuleIP(ruleArg(args, "--to-destination"))
+		gatewayIP := parseRuleIP(ruleArg(args, "-d"))
+		if ip == nil || gatewayIP == nil || subnetsContain(live.otherSubnets, ip) {
+			return false, false
+		}
+		if subnetsContain(live.subnets, ip) {
+			return true, !live.hostIPs[ip.String()]
+		}
+		return true, !hostHasIP(gatewayIP)
+	}
+	return false, false
+}
+
+func iptablesRuleArtifact(table string, rule string, orphan bool) dovesnapArtifact {
+	args := strings.Fields(rule)
+	delArgs := append([]string{"-t", table, "-D"}, args[1:]...)
+	return dovesnapArtifact{
+		Kind:   artifactIptables,
+		Name:   rule,
+		Detail: table,
+		Orphan: orphan,
+		remove: func() { iptablesRaw(false, delArgs...) },
+	}
+}
+
+func (c *Cleaner) iptablesArtifacts(live liveArtifacts) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	natRules, err := iptablesRaw(false, "-t", "nat", "-S")
+	if err != nil {
+		log.Warnf("cannot list iptables nat rules: %v", err)
+	} else {
+		for _, rule := range strings.Split(natRules, "\n") {
+			args := strings.Fields(rule)
+			if len(args) < 2 || args[0] != "-A" {
+				continue
+			}
+			if owned, orphan := classifyNatRule(args, live); owned {
+				artifacts = append(artifacts, iptablesRuleArtifact("nat", rule, orphan))
+			}
+		}
+	}
+	filterRules, err := iptablesRaw(false, "-t", "filter", "-S")
+	if err != nil {
+		log.Warnf("cannot list iptables filter rules: %v", err)
+		return artifacts
+	}
+	for _, rule := range strings.Split(filterRules, "\n") {
+		args := strings.Fields(rule)
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		// Port map and NAT forwarding accept rules for a dovesnap bridge: any in dovesnap's own chain, or (from older
+		// versions of dovesnap) for a live network's bridge (which may be named by ovs.bridge.name) or a default named one.
+		bridgeName := ruleArg(args, "-o")
+		if bridgeName == "" {
+			bridgeName = ruleArg(args, "-i")
+		}
+		if bridgeName == "" {
+			continue
+		}
+		if args[1] != dovesnapFwdChain && !live.bridges[bridgeName] && !strings.HasPrefix(bridgeName, bridgePrefix) {
+			continue
+		}
+		artifacts = append(artifacts, iptablesRuleArtifact("filter", rule, !live.bridges[bridgeName]))
+	}
+	return artifacts
+}
+
+func nftablesRuleArtifact(rule *nftables.Rule, orphan bool) dovesnapArtifact {
+	return dovesnapArtifact{
+		Kind:   artifactNftables,
+		Name:   getNftComment(rule),
+		Detail: rule.Chain.Name,
+		Orphan: orphan,
+		remove: func() {
+			conn, err := nftables.New()
+			if err != nil {
+				panic(err)
+			}
+			if err = conn.DelRule(rule); err != nil {
+				panic(err)
+			}
+			if err = conn.Flush(); err != nil {
+				panic(err)
+			}
+		},
+	}
+}
+
+func (c *Cleaner) nftablesArtifacts(live liveArtifacts) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	conn, err := nftables.New()
+	if err != nil {
+		return artifacts
+	}
+	table, err := conn.ListTableOfFamily(nftTableName, nftables.TableFamilyINet)
+	if err != nil {
+		// No nftables, or dovesnap has not used them.
+		return artifacts
+	}
+	for _, chainName := range []string{nftPrerouting, nftOutput, nftPostrouting, nftForward} {
+		rules, err := conn.GetRules(table, &nftables.Chain{Name: chainName, Table: table})
+		if err != nil {
+			log.Warnf("cannot list nftables %s rules: %v", chainName, err)
+			continue
+		}
+		for _, rule := range rules {
+			fields := strings.Fields(getNftComment(rule))
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case nftEgressComment:
+				ip := parseRuleIP(fields[1])
+				artifacts = append(artifacts, nftablesRuleArtifact(rule, ip == nil || !subnetsContain(live.subnets, ip)))
+			case nftPortMapComment:
+				artifacts = append(artifacts, nftablesRuleArtifact(rule, !live.bridges[fields[1]]))
+			}
+		}
+	}
+	return artifacts
+}
+
+func (c *Cleaner) faucetArtifacts(live liveArtifacts) []dovesnapArtifact {
+	artifacts := []dovesnapArtifact{}
+	for _, dp := range c.faucetconfrpcer.mustGetDpInfo("") {
+		if !strings.HasPrefix(dp.Description, dovesnapDpDescPfx) && !strings.HasPrefix(dp.Description, stackDpDescPfx) {
+			continue
+		}
+		dpName := dp.Name
+		artifacts = append(artifacts, dovesnapArtifact{
+			Kind:   artifactFaucetDp,
+			Name:   dpName,
+			Detail: dp.Description,
+			Orphan: !live.dpNames[dpName],
+			remove: func() { c.faucetconfrpcer.mustDeleteDp(dpName) },
+		})
+	}
+	return artifacts
+}
+
+// inventory returns all dovesnap artifacts on this host, in a safe removal order.
+func (c *Cleaner) inventory(live liveArtifacts) []dovesnapArtifact {
+	ovs := c.ovsArtifacts(live)
+	ovsPorts := make(map[string]dovesnapArtifact)
+	bridges := []dovesnapArtifact{}
+	artifacts := []dovesnapArtifact{}
+	for _, artifact := range ovs {
+		if artifact.Kind == artifactBridge {
+			bridges = append(bridges, artifact)
+			continue
+		}
+		ovsPorts[artifact.Name] = artifact
+		artifacts = append(artifacts, artifact)
+	}
+	artifacts = append(c.nftablesArtifacts(live), artifacts...)
+	artifacts = append(c.iptablesArtifacts(live), artifacts...)
+	artifacts = append(c.faucetArtifacts(live), artifacts...)
+	artifacts = append(artifacts, c.linkArtifacts(live, ovsPorts)...)
+	artifacts = append(artifacts, bridges...)
+	artifacts = append(artifacts, c.netNsArtifacts(live)...)
+	return artifacts
+}
+
+func (c *Cleaner) mustRemoveDockerNetworks() {
+	for _, netSummary := range c.dockerer.mustGetAllNetworks() {
+		if netSummary.Driver != DriverName {
+			continue
+		}
+		netInspect := c.dockerer.mustGetNetworkInspectFromID(netSummary.ID)
+		for containerID := range netInspect.Containers {
+			log.Infof("killing container %s on dovesnap network %s", containerID, netInspect.Name)
+			c.dockerer.mustKillContainer(containerID)
+		}
+		log.Infof("removing dovesnap network %s", netInspect.Name)
+		c.dockerer.mustRemoveNetwork(netSummary.ID)
+	}
+}
+
+func removeArtifact(artifact dovesnapArtifact) (err error) {
+	err = nil
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			err = fmt.Errorf("%v", rerr)
+		}
+	}()
+	artifact.remove()
+	return err
+}
+
+// Run reports dovesnap artifacts, and removes orphans (or everything, if removeAll).
+func (c *Cleaner) Run(dryRun bool, removeAll bool) error {
+	if removeAll && !dryRun {
+		c.mustRemoveDockerNetworks()
+	}
+	live := c.mustGetLiveArtifacts()
+	artifacts := c.inventory(live)
+	// Report orphans first within each kind, keeping kinds in removal (dependency) order.
+	for start := 0; start < len(artifacts); {
+		end := start + 1
+		for end < len(artifacts) && artifacts[end].Kind == artifacts[start].Kind {
+			end++
+		}
+		kindArtifacts := artifacts[start:end]
+		sort.SliceStable(kindArtifacts, func(i, j int) bool {
+			return kindArtifacts[i].Orphan && !kindArtifacts[j].Orphan
+		})
+		start = end
+	}
+	failed := 0
+	for _, artifact := range artifacts {
+		state := "live"
+		if artifact.Orphan {
+			state = "orphan"
+		}
+		fmt.Printf("%-6s %-8s %s %s\n", state, artifact.Kind, artifact.Name, artifact.Detail)
+		if dryRun || !(artifact.Orphan || removeAll) {
+			continue
+		}
+		if err := removeArtifact(artifact); err != nil {
+			log.Warnf("cannot remove %s %s: %v", artifact.Kind, artifact.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d artifacts could not be removed", failed)
+	}
+	return nil
+}
+
+func NewCleaner(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName string, flagFaucetconfrpcServerPort int, flagFaucetconfrpcKeydir string, flagFaucetconfrpcConnRetries int) *Cleaner {
+	c := &Cleaner{
+		dockerer:        dockerer{},
+		ovsdber:         ovsdber{},
+		faucetconfrpcer: faucetconfrpcer{},
+	}
+	c.dockerer.mustGetDockerClient()
+	c.shortEngineId = c.dockerer.mustGetShortEngineID()
+	c.mirrorBridgeName = getMirrorBrName(c.shortEngineId)
+	c.loopbackBridgeName = getLoopbackBrName(c.shortEngineId)
+	c.stackDpName = getStackDPName(c.shortEngineId)
+	c.faucetconfrpcer.mustGetGRPCClient(
+		flagFaucetconfrpcClientName,
+		flagFaucetconfrpcServerName,
+		flagFaucetconfrpcServerPort,
+		flagFaucetconfrpcKeydir,
+		flagFaucetconfrpcConnRetries)
+	c.ovsdber.waitForOvs()
+	return c
+}
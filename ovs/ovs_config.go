@@ -2,6 +2,7 @@ package ovs
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -25,16 +26,32 @@ const (
 	bridgeLbPort           = "ovs.bridge.lbport"
 	bridgeNameOption       = "ovs.bridge.name"
 	dhcpOption             = "ovs.bridge.dhcp"
+	dhcpDNSOption          = "ovs.bridge.dhcp_dns"
+	dhcpLeaseTimeOption    = "ovs.bridge.dhcp_lease_time"
+	dhcpRangeOption        = "ovs.bridge.dhcp_range"
+	dhcpReservationsOption = "ovs.bridge.dhcp_reservations"
+	dhcpResolvConfOption   = "ovs.bridge.dhcp_resolv_conf"
+	dhcpRouterOption       = "ovs.bridge.dhcp_router"
+	dhcpServerOption       = "ovs.bridge.dhcp_server"
+	dnsOption              = "ovs.bridge.dns"
+	dnsUpstreamOption      = "ovs.bridge.dns_upstream"
+	ipv6DNSOption          = "ovs.bridge.ipv6_dns"
+	ipv6RAOption           = "ovs.bridge.ipv6_ra"
 	mirrorTunnelVid        = "ovs.bridge.mirror_tunnel_vid"
 	modeOption             = "ovs.bridge.mode"
 	NATAclOption           = "ovs.bridge.nat_acl"
+	NATAclRulesOption      = "ovs.bridge.nat_acl_rules"
+	NATSourceOption        = "ovs.bridge.nat_source"
 	mtuOption              = "ovs.bridge.mtu"
 	vlanOption             = "ovs.bridge.vlan"
 	userspaceOption        = "ovs.bridge.userspace"
 	ovsLocalMacOption      = "ovs.bridge.ovs_local_mac"
 	vlanOutAclOption       = "ovs.bridge.vlan_out_acl"
+	vlanOutAclRulesOption  = "ovs.bridge.vlan_out_acl_rules"
 	defaultAclOption       = "ovs.bridge.default_acl"
+	defaultAclRulesOption  = "ovs.bridge.default_acl_rules"
 	preAllocatePortsOption = "ovs.bridge.preallocate_ports"
+	portSecurityOption     = "ovs.bridge.port_security"
 
 	defaultLbPort           = 99
 	defaultMTU              = 1500
@@ -51,7 +68,7 @@ const (
 	bridgePrefix                 = ovsDovesnapPrefix + "br"
 	containerEthName             = "eth"
 	netNsPath                    = "/var/run/netns"
-	dhcpStatePath                = "/var/run"
+	dovesnapStatePath            = "/var/lib/dovesnap"
 	ofPortLocal       OFPortType = 4294967294
 	ovsPortPrefix                = ovsDovesnapPrefix + "ve"
 	patchPrefix                  = ovsDovesnapPrefix
@@ -76,12 +93,25 @@ type StackMirrorConfig struct {
 	RemoteMirrorPort OFPortType
 }
 
+// getGatewayCidrs returns the gateway address(es) of a NAT or routed network, for the network's bridge.
+func getGatewayCidrs(ns NetworkState) []string {
+	cidrs := []string{}
+	if ns.Gateway != "" {
+		cidrs = append(cidrs, ns.Gateway+"/"+ns.GatewayMask)
+	}
+	if ns.Gateway6 != "" {
+		cidrs = append(cidrs, ns.Gateway6+"/"+ns.GatewayMask6)
+	}
+	return cidrs
+}
+
 func makeDynamicNetworkState(shortEngineId string) DynamicNetworkState {
 	return DynamicNetworkState{
 		ShortEngineId:    shortEngineId,
 		Containers:       make(map[string]ContainerState),
 		ExternalPorts:    make(map[string]ExternalPortState),
 		OtherBridgePorts: make(map[string]OtherBridgePortState),
+		DHCPLeases:       make(map[string]DHCPLease),
 	}
 }
 
@@ -169,10 +199,18 @@ func mustGetBridgeVLANOutAcl(r *networkplugin.CreateNetworkRequest) string {
 	return getGenericOption(r, vlanOutAclOption)
 }
 
+func mustGetBridgeVLANOutAclRules(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, vlanOutAclRulesOption)
+}
+
 func mustGetDefaultAcl(r *networkplugin.CreateNetworkRequest) string {
 	return getGenericOption(r, defaultAclOption)
 }
 
+func mustGetDefaultAclRules(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, defaultAclRulesOption)
+}
+
 func mustGetBridgeAddPorts(r *networkplugin.CreateNetworkRequest) string {
 	return getGenericOption(r, bridgeAddPorts)
 }
@@ -185,6 +223,10 @@ func mustGetNATAcl(r *networkplugin.CreateNetworkRequest) string {
 	return getGenericOption(r, NATAclOption)
 }
 
+func mustGetNATAclRules(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, NATAclRulesOption)
+}
+
 func mustGetGatewayIPFromData(data []*networkplugin.IPAMData) string {
 	if len(data) > 0 {
 		if data[0] != nil {
@@ -196,6 +238,17 @@ func mustGetGatewayIPFromData(data []*networkplugin.IPAMData) string {
 	return ""
 }
 
+func mustSplitGatewayIP(gatewayIP string) (string, string) {
+	if gatewayIP == "" {
+		return "", ""
+	}
+	parts := strings.Split(gatewayIP, "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		return parts[0], parts[1]
+	}
+	panic(fmt.Errorf("cannot parse gateway IP: %s", gatewayIP))
+}
+
 func mustGetGatewayIP(r *networkplugin.CreateNetworkRequest) (string, string) {
 	// Guess gateway IP, prefer IPv4.
 	ipv6Gw := mustGetGatewayIPFromData(r.IPv6Data)
@@ -204,20 +257,25 @@ func mustGetGatewayIP(r *networkplugin.CreateNetworkRequest) (string, string) {
 	if ipv4Gw != "" {
 		gatewayIP = ipv4Gw
 	}
-	if gatewayIP == "" {
+	return mustSplitGatewayIP(gatewayIP)
+}
+
+// mustGetGatewayIPv6 returns the IPv6 gateway of a dual stack network (an IPv6 only network's gateway is its only gateway).
+func mustGetGatewayIPv6(r *networkplugin.CreateNetworkRequest) (string, string) {
+	if mustGetGatewayIPFromData(r.IPv4Data) == "" {
 		return "", ""
 	}
-	parts := strings.Split(gatewayIP, "/")
-	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
-		return parts[0], parts[1]
-	}
-	panic(fmt.Errorf("cannot parse gateway IP: %s", gatewayIP))
+	return mustSplitGatewayIP(mustGetGatewayIPFromData(r.IPv6Data))
 }
 
 func mustGetBindInterface(r *networkplugin.CreateNetworkRequest) string {
 	return getGenericOption(r, bindInterfaceOption)
 }
 
+func mustGetNATSource(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, NATSourceOption)
+}
+
 func parseBool(optionVal string) bool {
 	boolVal, err := strconv.ParseBool(optionVal)
 	if err != nil {
@@ -230,6 +288,54 @@ func mustGetUseDHCP(r *networkplugin.CreateNetworkRequest) bool {
 	return parseBool(getGenericOption(r, dhcpOption))
 }
 
+func mustGetDHCPResolvConf(r *networkplugin.CreateNetworkRequest) bool {
+	return parseBool(getGenericOption(r, dhcpResolvConfOption))
+}
+
+func mustGetDHCPServer(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dhcpServerOption)
+}
+
+func mustGetDHCPRange(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dhcpRangeOption)
+}
+
+func mustGetDHCPRouter(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dhcpRouterOption)
+}
+
+func mustGetDHCPDNS(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dhcpDNSOption)
+}
+
+func mustGetDHCPLeaseTime(r *networkplugin.CreateNetworkRequest) uint {
+	return getGenericUintOption(r, dhcpLeaseTimeOption, defaultDhcpLeaseTime)
+}
+
+func mustGetDHCPReservations(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dhcpReservationsOption)
+}
+
+func mustGetDNS(r *networkplugin.CreateNetworkRequest) bool {
+	return parseBool(getGenericOption(r, dnsOption))
+}
+
+func mustGetPortSecurity(r *networkplugin.CreateNetworkRequest) bool {
+	return parseBool(getGenericOption(r, portSecurityOption))
+}
+
+func mustGetDNSUpstream(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, dnsUpstreamOption)
+}
+
+func mustGetIPv6RA(r *networkplugin.CreateNetworkRequest) bool {
+	return parseBool(getGenericOption(r, ipv6RAOption))
+}
+
+func mustGetIPv6DNS(r *networkplugin.CreateNetworkRequest) string {
+	return getGenericOption(r, ipv6DNSOption)
+}
+
 func mustGetUserspace(r *networkplugin.CreateNetworkRequest) bool {
 	return parseBool(getGenericOption(r, userspaceOption))
 }
@@ -261,8 +367,20 @@ func (d *Driver) getStackMirrorConfig(r *networkplugin.CreateNetworkRequest) Sta
 	}
 }
 
+func getStackDPName(shortEngineId string) string {
+	return "dovesnap" + shortEngineId
+}
+
+func getLoopbackBrName(shortEngineId string) string {
+	return ovsDovesnapPrefix + "lb" + shortEngineId
+}
+
+func getMirrorBrName(shortEngineId string) string {
+	return ovsDovesnapPrefix + "mir" + shortEngineId
+}
+
 func (d *Driver) mustGetStackDPName() string {
-	return "dovesnap" + d.shortEngineId
+	return getStackDPName(d.shortEngineId)
 }
 
 func (d *Driver) mustGetStackDP() (string, string) {
@@ -271,11 +389,11 @@ func (d *Driver) mustGetStackDP() (string, string) {
 }
 
 func (d *Driver) mustGetLoopbackBrName() string {
-	return ovsDovesnapPrefix + "lb" + d.shortEngineId
+	return getLoopbackBrName(d.shortEngineId)
 }
 
 func (d *Driver) mustGetMirrorBrName() string {
-	return ovsDovesnapPrefix + "mir" + d.shortEngineId
+	return getMirrorBrName(d.shortEngineId)
 }
 
 func (d *Driver) mustGetStackingInterface(stackingInterface string) (string, OFPortType, string) {
@@ -328,18 +446,62 @@ func mustGetBridgeDpidFromResource(r *network.Inspect) (string, uint64) {
 	return dpid, uintDpid
 }
 
+func getGatewayFromIPAMConfig(config network.IPAMConfig) (string, string) {
+	subnetIP := config.Subnet
+	parts := strings.Split(subnetIP, "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		return config.Gateway, parts[1]
+	}
+	return "", ""
+}
+
 func getGatewayFromResource(r *network.Inspect) (string, string) {
 	if len(r.IPAM.Config) > 0 {
-		config := r.IPAM.Config[0]
-		subnetIP := config.Subnet
-		parts := strings.Split(subnetIP, "/")
-		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
-			return config.Gateway, parts[1]
+		return getGatewayFromIPAMConfig(r.IPAM.Config[0])
+	}
+	return "", ""
+}
+
+// getGatewayIPv6FromResource returns the IPv6 gateway of a dual stack network.
+func getGatewayIPv6FromResource(r *network.Inspect) (string, string) {
+	if len(r.IPAM.Config) < 2 || net.ParseIP(r.IPAM.Config[0].Gateway).To4() == nil {
+		return "", ""
+	}
+	for _, config := range r.IPAM.Config[1:] {
+		if ip := net.ParseIP(config.Gateway); ip != nil && ip.To4() == nil {
+			return getGatewayFromIPAMConfig(config)
 		}
 	}
 	return "", ""
 }
 
+func mustParseVLAN(vlanStr string) uint {
+	vlan, err := strconv.ParseUint(strings.TrimSpace(vlanStr), 10, 16)
+	if err != nil {
+		panic(fmt.Errorf("invalid VLAN %s: %v", vlanStr, err))
+	}
+	if vlan < 1 || vlan > 4094 {
+		panic(fmt.Errorf("VLAN %d out of range (1-4094)", vlan))
+	}
+	return uint(vlan)
+}
+
+func mustParseVLANs(vlansStr string) []uint {
+	vlans := []uint{}
+	for _, vlanStr := range strings.Split(vlansStr, ",") {
+		vlans = append(vlans, mustParseVLAN(vlanStr))
+	}
+	return vlans
+}
+
+func formatVLANs(vlans []uint) string {
+	vlanStrs := []string{}
+	for _, vlan := range vlans {
+		vlanStrs = append(vlanStrs, fmt.Sprintf("%d", vlan))
+	}
+	return strings.Join(vlanStrs, ",")
+}
+
 func getStrForNetwork(networkStr string, networkName string) string {
 	networkStrs := ""
 	networksStrsList := strings.Split(networkStr, "/")
@@ -366,6 +528,7 @@ func getNetworkStateFromResource(r *network.Inspect, shortEngineId string) (Netw
 	}()
 	dpid, uintDpid := mustGetBridgeDpidFromResource(r)
 	gateway, mask := getGatewayFromResource(r)
+	gateway6, mask6 := getGatewayIPv6FromResource(r)
 	ns = NetworkState{
 		NetworkName:          r.Name,
 		BridgeName:           mustGetBridgeNameFromResource(r),
@@ -375,16 +538,35 @@ func getNetworkStateFromResource(r *network.Inspect, shortEngineId string) (Netw
 		MTU:                  getUintOptionFromResource(r, mtuOption, defaultMTU),
 		PreAllocatePorts:     getUintOptionFromResource(r, preAllocatePortsOption, 0),
 		Mode:                 getStrOptionFromResource(r, modeOption, defaultMode),
+		Internal:             r.Internal,
 		FlatBindInterface:    getStrOptionFromResource(r, bindInterfaceOption, ""),
 		AddPorts:             getStrOptionFromResource(r, bridgeAddPorts, ""),
 		AddCoproPorts:        getStrOptionFromResource(r, bridgeAddCoproPorts, ""),
 		UseDHCP:              parseBool(getStrOptionFromResource(r, dhcpOption, "")),
+		DHCPServer:           getStrOptionFromResource(r, dhcpServerOption, ""),
+		DHCPRange:            getStrOptionFromResource(r, dhcpRangeOption, ""),
+		DHCPRouter:           getStrOptionFromResource(r, dhcpRouterOption, ""),
+		DHCPDNS:              getStrOptionFromResource(r, dhcpDNSOption, ""),
+		DHCPLeaseTime:        getUintOptionFromResource(r, dhcpLeaseTimeOption, defaultDhcpLeaseTime),
+		DHCPReservations:     getStrOptionFromResource(r, dhcpReservationsOption, ""),
+		DHCPResolvConf:       parseBool(getStrOptionFromResource(r, dhcpResolvConfOption, "")),
 		Userspace:            parseBool(getStrOptionFromResource(r, userspaceOption, "")),
+		IPv6RA:               parseBool(getStrOptionFromResource(r, ipv6RAOption, "")),
+		DNS:                  parseBool(getStrOptionFromResource(r, dnsOption, "")),
+		DNSUpstream:          getStrOptionFromResource(r, dnsUpstreamOption, ""),
+		PortSecurity:         parseBool(getStrOptionFromResource(r, portSecurityOption, "")),
+		IPv6DNS:              getStrOptionFromResource(r, ipv6DNSOption, ""),
 		Gateway:              gateway,
 		GatewayMask:          mask,
+		Gateway6:             gateway6,
+		GatewayMask6:         mask6,
 		NATAcl:               getStrOptionFromResource(r, NATAclOption, ""),
+		NATAclRules:          getStrOptionFromResource(r, NATAclRulesOption, ""),
+		NATSource:            getStrOptionFromResource(r, NATSourceOption, ""),
 		VLANOutAcl:           getStrOptionFromResource(r, vlanOutAclOption, ""),
+		VLANOutAclRules:      getStrOptionFromResource(r, vlanOutAclRulesOption, ""),
 		DefaultAcl:           getStrOptionFromResource(r, defaultAclOption, ""),
+		DefaultAclRules:      getStrOptionFromResource(r, defaultAclRulesOption, ""),
 		OvsLocalMac:          getStrOptionFromResource(r, ovsLocalMacOption, ""),
 		Controller:           getStrOptionFromResource(r, bridgeController, ""),
 		DynamicNetworkStates: makeDynamicNetworkState(shortEngineId),
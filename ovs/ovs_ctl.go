@@ -0,0 +1,95 @@
+package ovs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ctlCommand is a dovesnap ctl command, which posts to a status server endpoint.
+type ctlCommand struct {
+	path  string
+	usage string
+	form  func(args []string) url.Values
+}
+
+var ctlCommands = map[string]ctlCommand{
+	"set-portacl": {
+		path:  "/containers/portacl",
+		usage: "set-portacl <container> <acls>",
+		form:  func(args []string) url.Values { return url.Values{"acls": {args[0]}} },
+	},
+	"clear-portacl": {
+		path:  "/containers/portacl",
+		usage: "clear-portacl <container>",
+		form:  func(args []string) url.Values { return url.Values{"clear": {"true"}} },
+	},
+	"set-mirror": {
+		path:  "/containers/mirror",
+		usage: "set-mirror <container> <true|false>",
+		form:  func(args []string) url.Values { return url.Values{"mirror": {args[0]}} },
+	},
+	"clear-mirror": {
+		path:  "/containers/mirror",
+		usage: "clear-mirror <container>",
+		form:  func(args []string) url.Values { return url.Values{"clear": {"true"}} },
+	},
+	"quarantine": {
+		path:  "/containers/quarantine",
+		usage: "quarantine <container> <reason>",
+		form:  func(args []string) url.Values { return url.Values{"reason": {args[0]}, "user": {os.Getenv("USER")}} },
+	},
+	"release": {
+		path:  "/containers/release",
+		usage: "release <container>",
+		form:  func(args []string) url.Values { return url.Values{"user": {os.Getenv("USER")}} },
+	},
+}
+
+func ctlUsage() error {
+	usages := []string{}
+	for _, command := range ctlCommands {
+		usages = append(usages, command.usage)
+	}
+	sort.Strings(usages)
+	return fmt.Errorf("usage: dovesnap ctl [--status_addr=<host:port>] [--network=<network>] <command>, where command is one of: %s", strings.Join(usages, ", "))
+}
+
+// RunCtl runs a dovesnap ctl command, against a running dovesnap's status server.
+func RunCtl(statusAddr string, networkName string, args []string) error {
+	if len(args) < 2 {
+		return ctlUsage()
+	}
+	command, ok := ctlCommands[args[0]]
+	if !ok || len(args) != strings.Count(command.usage, "<")+1 {
+		return ctlUsage()
+	}
+	form := command.form(args[2:])
+	form.Set("container", args[1])
+	if networkName != "" {
+		form.Set("network", networkName)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", statusAddr, command.path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(webRequestHeader, "ctl")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
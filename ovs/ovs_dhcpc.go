@@ -0,0 +1,375 @@
+package ovs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	dhcpClientRestartDelay    = 5 * time.Second
+	dhcpClientMaxRestartDelay = 5 * time.Minute
+	dhcpClientRetryDelay      = 10 * time.Second
+	defaultDhcpClientLease    = time.Hour
+
+	dhcpClientRequesting = "requesting"
+	dhcpClientBound      = "bound"
+	dhcpClientFailed     = "failed"
+)
+
+// DHCPClientLease is the lease a container's DHCP client holds.
+type DHCPClientLease struct {
+	IP        string
+	Prefix    int
+	Router    string
+	DNS       []string
+	Server    string
+	LeaseTime uint32
+	Obtained  int64
+	Renewals  uint
+}
+
+// DHCPClientHealth is the state of a container's DHCP client.
+type DHCPClientHealth struct {
+	State       string
+	Restarts    uint
+	LastError   string
+	LastFailure int64
+}
+
+// dhcpClient maintains a DHCP lease for a container's interface, from dovesnap (not the container).
+type dhcpClient struct {
+	networkID   string
+	endpointID  string
+	containerID string
+	pid         int
+	ifName      string
+	resolvConf  bool
+	opChan      chan DovesnapOp
+	quit        chan struct{}
+	done        chan struct{}
+	// Only accessed by the client's goroutine (copies are sent to the resource manager).
+	lease  DHCPClientLease
+	health DHCPClientHealth
+}
+
+func getDhcpClientLease(lease *nclient4.Lease, renewals uint) DHCPClientLease {
+	ack := lease.ACK
+	prefix, _ := ack.SubnetMask().Size()
+	clientLease := DHCPClientLease{
+		IP:        ack.YourIPAddr.String(),
+		Prefix:    prefix,
+		DNS:       []string{},
+		Server:    ack.ServerIdentifier().String(),
+		LeaseTime: uint32(ack.IPAddressLeaseTime(defaultDhcpClientLease) / time.Second),
+		Obtained:  lease.CreationTime.Unix(),
+		Renewals:  renewals,
+	}
+	if routers := ack.Router(); len(routers) > 0 {
+		clientLease.Router = routers[0].String()
+	}
+	for _, dns := range ack.DNS() {
+		clientLease.DNS = append(clientLease.DNS, dns.String())
+	}
+	return clientLease
+}
+
+// resolvConfNameservers replaces the nameservers in resolv.conf content (keeping search domains and options).
+func resolvConfNameservers(content string, dns []string) string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "nameserver" {
+			continue
+		}
+		if line != "" || len(lines) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	for _, server := range dns {
+		lines = append(lines, "nameserver "+server)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// configureResolvConf writes a lease's DNS servers to the container's resolv.conf.
+// The file is usually bind mounted by docker, so is rewritten in place rather than replaced.
+func (c *dhcpClient) configureResolvConf(dns []string) error {
+	resolvConfFile := fmt.Sprintf("/proc/%d/root/etc/resolv.conf", c.pid)
+	content, err := os.ReadFile(resolvConfFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(resolvConfFile, []byte(resolvConfNameservers(string(content), dns)), 0644)
+}
+
+// configure applies a lease to the container's interface.
+func (c *dhcpClient) configure(handle *netlink.Handle, link netlink.Link, lease DHCPClientLease, oldLease DHCPClientLease) error {
+	addr, err := netlink.ParseAddr(fmt.Sprintf("%s/%d", lease.IP, lease.Prefix))
+	if err != nil {
+		return err
+	}
+	if oldLease.IP != "" && oldLease.IP != lease.IP {
+		if oldAddr, err := netlink.ParseAddr(fmt.Sprintf("%s/%d", oldLease.IP, oldLease.Prefix)); err == nil {
+			handle.AddrDel(link, oldAddr)
+		}
+	}
+	if err := handle.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("cannot add %s to %s: %v", addr, c.ifName, err)
+	}
+	if lease.Router != "" {
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP(lease.Router)}
+		if err := handle.RouteReplace(route); err != nil {
+			return fmt.Errorf("cannot add default route via %s: %v", lease.Router, err)
+		}
+	}
+	if c.resolvConf && len(lease.DNS) > 0 && !reflect.DeepEqual(lease.DNS, oldLease.DNS) {
+		if err := c.configureResolvConf(lease.DNS); err != nil {
+			return fmt.Errorf("cannot write DNS servers to resolv.conf: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *dhcpClient) deconfigure(handle *netlink.Handle, link netlink.Link, lease DHCPClientLease) {
+	if addr, err := netlink.ParseAddr(fmt.Sprintf("%s/%d", lease.IP, lease.Prefix)); err == nil {
+		handle.AddrDel(link, addr)
+	}
+	c.lease = DHCPClientLease{}
+}
+
+// report sends the client's lease and health to the resource manager, to update the container's state.
+func (c *dhcpClient) report(operation string) {
+	select {
+	case c.opChan <- DovesnapOp{
+		Operation:        operation,
+		NetworkID:        c.networkID,
+		EndpointID:       c.endpointID,
+		DHCPClientLease:  c.lease,
+		DHCPClientHealth: c.health,
+	}:
+	case <-c.quit:
+	}
+}
+
+func (c *dhcpClient) wait(delay time.Duration) bool {
+	select {
+	case <-c.quit:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// run obtains a lease, and renews it until told to quit or the lease cannot be renewed.
+func (c *dhcpClient) run() (err error) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			err = fmt.Errorf("%v", rerr)
+		}
+	}()
+	cns, err := openContainerNetNs(c.pid)
+	if err != nil {
+		return err
+	}
+	defer cns.Close()
+	handle := cns.handle
+	link, err := cns.linkByName(c.ifName)
+	if err != nil {
+		return err
+	}
+	// The client's socket stays in the namespace, once opened.
+	var client *nclient4.Client
+	if err := cns.do(func() (err error) {
+		client, err = nclient4.New(c.ifName)
+		return err
+	}); err != nil {
+		return cns.error("start DHCP client on", c.ifName, err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	lease, err := client.Request(ctx)
+	if err != nil {
+		return err
+	}
+	renewals := uint(0)
+	current := getDhcpClientLease(lease, renewals)
+	if err := c.configure(handle, link, current, c.lease); err != nil {
+		return err
+	}
+	log.Infof("DHCP lease for %s: %s/%d", c.containerID, current.IP, current.Prefix)
+	c.lease = current
+	c.health.State = dhcpClientBound
+	c.report("dhcplease")
+
+	for {
+		leaseTime := lease.ACK.IPAddressLeaseTime(defaultDhcpClientLease)
+		expiry := lease.CreationTime.Add(leaseTime)
+		renewal := lease.CreationTime.Add(lease.ACK.IPAddressRenewalTime(leaseTime / 2))
+		if !c.wait(time.Until(renewal)) {
+			return nil
+		}
+		for {
+			newLease, err := client.Renew(ctx, lease)
+			if err == nil {
+				lease = newLease
+				break
+			}
+			var nak *nclient4.ErrNak
+			if errors.As(err, &nak) || time.Now().After(expiry) {
+				c.deconfigure(handle, link, current)
+				return fmt.Errorf("cannot renew lease for %s: %v", current.IP, err)
+			}
+			log.Warnf("cannot renew DHCP lease for %s, will retry: %v", c.containerID, err)
+			if !c.wait(dhcpClientRetryDelay) {
+				return nil
+			}
+		}
+		renewals++
+		newCurrent := getDhcpClientLease(lease, renewals)
+		if err := c.configure(handle, link, newCurrent, current); err != nil {
+			return err
+		}
+		current = newCurrent
+		c.lease = current
+		c.report("dhcplease")
+	}
+}
+
+// supervise runs the client, restarting it with backoff if it fails.
+func (c *dhcpClient) supervise() {
+	defer close(c.done)
+	delay := dhcpClientRestartDelay
+	for {
+		c.health.State = dhcpClientRequesting
+		err := c.run()
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+		// Back off only while the client cannot get a lease at all.
+		if c.health.State == dhcpClientBound {
+			delay = dhcpClientRestartDelay
+		}
+		if err == nil {
+			err = fmt.Errorf("client exited")
+		}
+		c.health.State = dhcpClientFailed
+		c.health.LastError = err.Error()
+		c.health.LastFailure = time.Now().Unix()
+		log.Warnf("DHCP client for %s failed, restarting in %s: %v", c.containerID, delay, err)
+		c.report("dhcpfailed")
+		if !c.wait(delay) {
+			return
+		}
+		delay *= 2
+		if delay > dhcpClientMaxRestartDelay {
+			delay = dhcpClientMaxRestartDelay
+		}
+		c.health.Restarts++
+		c.health.State = dhcpClientRequesting
+		c.report("dhcprestarted")
+	}
+}
+
+func (c *dhcpClient) stop() {
+	close(c.quit)
+	<-c.done
+	log.Infof("stopped DHCP client for %s", c.containerID)
+}
+
+func startDhcpClient(d *Driver, networkID string, endpointID string, containerID string, pid int, ifName string, resolvConf bool) *dhcpClient {
+	c := &dhcpClient{
+		networkID:   networkID,
+		endpointID:  endpointID,
+		containerID: containerID,
+		pid:         pid,
+		ifName:      ifName,
+		resolvConf:  resolvConf,
+		opChan:      d.dovesnapOpChan,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		health:      DHCPClientHealth{State: dhcpClientRequesting},
+	}
+	go c.supervise()
+	log.Infof("started DHCP client for %s", containerID)
+	return c
+}
+
+var dhcpClientEvents = map[string]string{
+	"dhcplease":     "DHCP_LEASE",
+	"dhcpfailed":    "DHCP_FAILED",
+	"dhcprestarted": "DHCP_RESTARTED",
+}
+
+// mustHandleDhcpClient records a container's DHCP client lease and health, when it obtains a lease, fails or restarts.
+func mustHandleDhcpClient(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleDhcpClient failed: %v", rerr)
+		}
+	}()
+
+	containerMap, ok := (*OFPorts)[opMsg.EndpointID]
+	if !ok || containerMap.state != endpointJoined {
+		return
+	}
+	ns := d.networks[opMsg.NetworkID]
+	containerState, ok := ns.DynamicNetworkStates.Containers[opMsg.EndpointID]
+	if !ok {
+		return
+	}
+	lease := opMsg.DHCPClientLease
+	health := opMsg.DHCPClientHealth
+	containerState.HostIP = lease.IP
+	containerState.DHCPClient = lease
+	containerState.DHCPHealth = health
+	ns.DynamicNetworkStates.Containers[opMsg.EndpointID] = containerState
+	if containerState.PortSecurityAcl != "" {
+		d.mustSetPortSecurityAcl(opMsg.NetworkID, opMsg.EndpointID, containerState)
+	}
+	d.updateDNS(opMsg.NetworkID)
+	compilePolicies(d, opMsg.NetworkID)
+
+	details := map[string]string{
+		"name":     containerState.Name,
+		"id":       containerState.Id,
+		"ip":       lease.IP,
+		"state":    health.State,
+		"restarts": fmt.Sprintf("%d", health.Restarts),
+	}
+	if opMsg.Operation == "dhcplease" {
+		details["router"] = lease.Router
+		details["server"] = lease.Server
+		details["lease_time"] = fmt.Sprintf("%d", lease.LeaseTime)
+		details["renewals"] = fmt.Sprintf("%d", lease.Renewals)
+	} else {
+		details["error"] = health.LastError
+	}
+	d.notifyMsgChan <- NotifyMsg{
+		Type:         "CONTAINER",
+		Operation:    dhcpClientEvents[opMsg.Operation],
+		NetworkState: ns,
+		Details:      details,
+	}
+}
@@ -0,0 +1,14 @@
+package ovs
+
+import "testing"
+
+func TestResolvConfNameservers(t *testing.T) {
+	content := "search example.com\nnameserver 127.0.0.11\noptions ndots:0\n"
+	want := "search example.com\noptions ndots:0\nnameserver 192.168.10.53\nnameserver 192.168.10.54\n"
+	if got := resolvConfNameservers(content, []string{"192.168.10.53", "192.168.10.54"}); got != want {
+		t.Errorf("resolvConfNameservers() = %q, want %q", got, want)
+	}
+	if got := resolvConfNameservers("", []string{"192.168.10.53"}); got != "nameserver 192.168.10.53\n" {
+		t.Errorf("resolvConfNameservers() of empty file = %q", got)
+	}
+}
@@ -0,0 +1,588 @@
+package ovs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dhcpServerPortPrefix = ovsDovesnapPrefix + "dh"
+	dhcpOfferTime        = 30 * time.Second
+	defaultDhcpLeaseTime = 3600
+)
+
+// DHCPLease is an address leased by dovesnap's DHCP server.
+type DHCPLease struct {
+	MacAddress string
+	IP         string
+	Hostname   string
+	Expiry     int64
+}
+
+func (lease DHCPLease) expired(now time.Time) bool {
+	return now.Unix() >= lease.Expiry
+}
+
+// dhcpServer is a DHCPv4 server for a flat network, bound to an OVS internal port on the network's bridge.
+type dhcpServer struct {
+	mu           sync.Mutex
+	portName     string
+	serverIP     net.IP
+	subnet       *net.IPNet
+	rangeStart   net.IP
+	rangeEnd     net.IP
+	router       net.IP
+	dns          []net.IP
+	leaseTime    time.Duration
+	reservations map[string]net.IP
+	// labelReservations are reservations from container labels, which take precedence over reservations.
+	labelReservations map[string]net.IP
+	leases            map[string]DHCPLease
+	// declined are the expiry times of addresses clients declined (as something else has them), by address.
+	declined  map[string]int64
+	leaseFile string
+	server    *server4.Server
+}
+
+func dhcpServerPortName(networkID string) string {
+	return dhcpServerPortPrefix + truncateID(networkID)
+}
+
+func dhcpLeaseFile(bridgeName string) string {
+	return filepath.Join(dovesnapStatePath, fmt.Sprintf("dhcp-leases-%s.json", bridgeName))
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func parseIPv4(ipStr string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(ipStr))
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %s", ipStr)
+	}
+	return ip.To4(), nil
+}
+
+// parseDhcpReservations parses a comma separated list of mac=ip reservations.
+func parseDhcpReservations(reservationsStr string) (map[string]net.IP, error) {
+	reservations := make(map[string]net.IP)
+	if reservationsStr == "" {
+		return reservations, nil
+	}
+	for _, reservation := range strings.Split(reservationsStr, ",") {
+		parts := strings.SplitN(reservation, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid DHCP reservation %s", reservation)
+		}
+		mac, err := net.ParseMAC(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		ip, err := parseIPv4(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		reservations[mac.String()] = ip
+	}
+	return reservations, nil
+}
+
+// newDhcpServer returns a DHCP server for a network's config (without starting it).
+func newDhcpServer(networkID string, ns NetworkState) (*dhcpServer, error) {
+	serverIP, subnet, err := net.ParseCIDR(ns.DHCPServer)
+	if err != nil || serverIP.To4() == nil {
+		return nil, fmt.Errorf("invalid DHCP server address %s", ns.DHCPServer)
+	}
+	s := &dhcpServer{
+		portName:          dhcpServerPortName(networkID),
+		serverIP:          serverIP.To4(),
+		subnet:            subnet,
+		dns:               []net.IP{},
+		leaseTime:         time.Duration(ns.DHCPLeaseTime) * time.Second,
+		leases:            make(map[string]DHCPLease),
+		declined:          make(map[string]int64),
+		labelReservations: make(map[string]net.IP),
+		leaseFile:         dhcpLeaseFile(ns.BridgeName),
+	}
+	if s.leaseTime == 0 {
+		s.leaseTime = defaultDhcpLeaseTime * time.Second
+	}
+	// By default, lease the whole subnet, except the network and broadcast addresses.
+	s.rangeStart = ipIncrement(subnet.IP.To4())
+	broadcast := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(broadcast, ipToUint32(subnet.IP)|^binary.BigEndian.Uint32(subnet.Mask))
+	s.rangeEnd = make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(s.rangeEnd, ipToUint32(broadcast)-1)
+	if ns.DHCPRange != "" {
+		parts := strings.Split(ns.DHCPRange, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid DHCP range %s", ns.DHCPRange)
+		}
+		if s.rangeStart, err = parseIPv4(parts[0]); err != nil {
+			return nil, err
+		}
+		if s.rangeEnd, err = parseIPv4(parts[1]); err != nil {
+			return nil, err
+		}
+		if !subnet.Contains(s.rangeStart) || !subnet.Contains(s.rangeEnd) || ipToUint32(s.rangeStart) > ipToUint32(s.rangeEnd) {
+			return nil, fmt.Errorf("DHCP range %s is not within %s", ns.DHCPRange, subnet)
+		}
+	}
+	if ns.DHCPRouter != "" {
+		if s.router, err = parseIPv4(ns.DHCPRouter); err != nil {
+			return nil, err
+		}
+	}
+	if ns.DHCPDNS != "" {
+		for _, dnsStr := range strings.Split(ns.DHCPDNS, ",") {
+			dns, err := parseIPv4(dnsStr)
+			if err != nil {
+				return nil, err
+			}
+			s.dns = append(s.dns, dns)
+		}
+	}
+	if s.reservations, err = parseDhcpReservations(ns.DHCPReservations); err != nil {
+		return nil, err
+	}
+	for mac, ip := range s.reservations {
+		if !subnet.Contains(ip) {
+			return nil, fmt.Errorf("DHCP reservation %s for %s is not within %s", ip, mac, subnet)
+		}
+	}
+	return s, nil
+}
+
+func (s *dhcpServer) inRange(ip net.IP) bool {
+	return ipToUint32(ip) >= ipToUint32(s.rangeStart) && ipToUint32(ip) <= ipToUint32(s.rangeEnd)
+}
+
+// reservation returns the address reserved for a MAC, if any (caller must hold lock).
+func (s *dhcpServer) reservation(mac string) (net.IP, bool) {
+	if reserved, ok := s.labelReservations[mac]; ok {
+		return reserved, true
+	}
+	reserved, ok := s.reservations[mac]
+	return reserved, ok
+}
+
+// reservedByOther returns true if an address is reserved for a MAC other than mac (caller must hold lock).
+func (s *dhcpServer) reservedByOther(mac string, ip net.IP) bool {
+	for _, reservations := range []map[string]net.IP{s.labelReservations, s.reservations} {
+		for otherMac := range reservations {
+			if reserved, _ := s.reservation(otherMac); otherMac != mac && ip.Equal(reserved) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canLease returns true if an address can be leased to a MAC (caller must hold lock).
+func (s *dhcpServer) canLease(mac string, ip net.IP, now time.Time) bool {
+	if ip == nil || ip.To4() == nil || !s.subnet.Contains(ip) || ip.Equal(s.serverIP) || ip.Equal(s.router) {
+		return false
+	}
+	if expiry, ok := s.declined[ip.String()]; ok && now.Unix() < expiry {
+		return false
+	}
+	if reserved, ok := s.reservation(mac); ok {
+		return ip.Equal(reserved)
+	}
+	if !s.inRange(ip) || s.reservedByOther(mac, ip) {
+		return false
+	}
+	for otherMac, lease := range s.leases {
+		if otherMac != mac && lease.IP == ip.String() && !lease.expired(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate returns an address for a MAC: its reservation, else its previous lease, else the requested address, else the lowest free address.
+func (s *dhcpServer) allocate(mac string, requested net.IP, now time.Time) net.IP {
+	if reserved, ok := s.reservation(mac); ok {
+		if s.canLease(mac, reserved, now) {
+			return reserved
+		}
+		return nil
+	}
+	if lease, ok := s.leases[mac]; ok {
+		if ip := net.ParseIP(lease.IP); s.canLease(mac, ip, now) {
+			return ip.To4()
+		}
+	}
+	if s.canLease(mac, requested, now) {
+		return requested.To4()
+	}
+	for i := ipToUint32(s.rangeStart); i <= ipToUint32(s.rangeEnd); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, i)
+		if s.canLease(mac, ip, now) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// reserve reserves an address for a MAC by container label, if it is within the subnet and not the server's,
+// the router's, or reserved or leased for another MAC.
+func (s *dhcpServer) reserve(mac string, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.subnet.Contains(ip) || ip.Equal(s.serverIP) || ip.Equal(s.router) {
+		return fmt.Errorf("DHCP reservation %s for %s is not available within %s", ip, mac, s.subnet)
+	}
+	if s.reservedByOther(mac, ip) {
+		return fmt.Errorf("DHCP reservation %s for %s is already reserved", ip, mac)
+	}
+	now := time.Now()
+	for otherMac, lease := range s.leases {
+		if otherMac != mac && lease.IP == ip.String() && !lease.expired(now) {
+			return fmt.Errorf("DHCP reservation %s for %s is already leased to %s", ip, mac, otherMac)
+		}
+	}
+	s.labelReservations[mac] = ip
+	return nil
+}
+
+// unreserve removes a MAC's label reservation (static reservations remain).
+func (s *dhcpServer) unreserve(mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.labelReservations, mac)
+}
+
+// activeLeases returns a copy of the unexpired leases.
+func (s *dhcpServer) activeLeases() map[string]DHCPLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	leases := make(map[string]DHCPLease)
+	for mac, lease := range s.leases {
+		if !lease.expired(now) {
+			leases[mac] = lease
+		}
+	}
+	return leases
+}
+
+func (s *dhcpServer) loadLeases() {
+	content, err := os.ReadFile(s.leaseFile)
+	if err != nil {
+		return
+	}
+	leases := make(map[string]DHCPLease)
+	if err := json.Unmarshal(content, &leases); err != nil {
+		log.Warnf("cannot parse DHCP leases from %s: %v", s.leaseFile, err)
+		return
+	}
+	now := time.Now()
+	for mac, lease := range leases {
+		if !lease.expired(now) {
+			s.leases[mac] = lease
+		}
+	}
+	log.Infof("restored %d DHCP leases from %s", len(s.leases), s.leaseFile)
+}
+
+// saveLeases persists the leases (caller must hold lock).
+func (s *dhcpServer) saveLeases() {
+	content, err := json.Marshal(s.leases)
+	if err != nil {
+		log.Warnf("cannot encode DHCP leases: %v", err)
+		return
+	}
+	tmpFile := s.leaseFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		log.Warnf("cannot save DHCP leases to %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, s.leaseFile); err != nil {
+		log.Warnf("cannot save DHCP leases to %s: %v", s.leaseFile, err)
+	}
+}
+
+func (s *dhcpServer) reply(req *dhcpv4.DHCPv4, messageType dhcpv4.MessageType, ip net.IP) (*dhcpv4.DHCPv4, error) {
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(messageType),
+		dhcpv4.WithServerIP(s.serverIP),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.serverIP)),
+	}
+	if messageType != dhcpv4.MessageTypeNak {
+		modifiers = append(modifiers,
+			dhcpv4.WithYourIP(ip),
+			dhcpv4.WithNetmask(s.subnet.Mask),
+			dhcpv4.WithLeaseTime(uint32(s.leaseTime/time.Second)))
+		if s.router != nil {
+			modifiers = append(modifiers, dhcpv4.WithRouter(s.router))
+		}
+		if len(s.dns) > 0 {
+			modifiers = append(modifiers, dhcpv4.WithDNS(s.dns...))
+		}
+	}
+	return dhcpv4.NewReplyFromRequest(req, modifiers...)
+}
+
+// response returns the response to a DHCP message, if any.
+func (s *dhcpServer) response(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mac := req.ClientHWAddr.String()
+	now := time.Now()
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		ip := s.allocate(mac, req.RequestedIPAddress(), now)
+		if ip == nil {
+			return nil, fmt.Errorf("no free address for %s", mac)
+		}
+		// Hold the address briefly for the client's request.
+		if lease, ok := s.leases[mac]; !ok || lease.IP != ip.String() || lease.Expiry < now.Add(dhcpOfferTime).Unix() {
+			s.leases[mac] = DHCPLease{MacAddress: mac, IP: ip.String(), Hostname: req.HostName(), Expiry: now.Add(dhcpOfferTime).Unix()}
+		}
+		return s.reply(req, dhcpv4.MessageTypeOffer, ip)
+	case dhcpv4.MessageTypeRequest:
+		if serverID := req.ServerIdentifier(); serverID != nil && !serverID.Equal(s.serverIP) {
+			// Client chose another server.
+			if lease, ok := s.leases[mac]; ok && lease.Expiry <= now.Add(dhcpOfferTime).Unix() {
+				delete(s.leases, mac)
+			}
+			return nil, nil
+		}
+		ip := req.RequestedIPAddress()
+		if ip == nil {
+			ip = req.ClientIPAddr
+		}
+		if !s.canLease(mac, ip, now) {
+			return s.reply(req, dhcpv4.MessageTypeNak, nil)
+		}
+		s.leases[mac] = DHCPLease{MacAddress: mac, IP: ip.String(), Hostname: req.HostName(), Expiry: now.Add(s.leaseTime).Unix()}
+		s.saveLeases()
+		log.Infof("DHCP leased %s to %s on %s", ip, mac, s.portName)
+		return s.reply(req, dhcpv4.MessageTypeAck, ip)
+	case dhcpv4.MessageTypeRelease:
+		if lease, ok := s.leases[mac]; ok && lease.IP == req.ClientIPAddr.String() {
+			delete(s.leases, mac)
+			s.saveLeases()
+		}
+	case dhcpv4.MessageTypeDecline:
+		// Something else has the address, so don't lease it for now.
+		declined := req.RequestedIPAddress()
+		if declined != nil {
+			log.Warnf("DHCP address %s declined by %s on %s", declined, mac, s.portName)
+			for ip, expiry := range s.declined {
+				if now.Unix() >= expiry {
+					delete(s.declined, ip)
+				}
+			}
+			s.declined[declined.String()] = now.Add(s.leaseTime).Unix()
+			delete(s.leases, mac)
+			s.saveLeases()
+		}
+	case dhcpv4.MessageTypeInform:
+		return s.reply(req, dhcpv4.MessageTypeAck, nil)
+	}
+	return nil, nil
+}
+
+func (s *dhcpServer) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return
+	}
+	resp, err := s.response(req)
+	if err != nil {
+		log.Warnf("cannot respond to DHCP %s on %s: %v", req.MessageType(), s.portName, err)
+		return
+	}
+	if resp == nil {
+		return
+	}
+	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		log.Warnf("cannot send DHCP %s on %s: %v", resp.MessageType(), s.portName, err)
+	}
+}
+
+func (s *dhcpServer) start() error {
+	s.loadLeases()
+	server, err := server4.NewServer(s.portName, &net.UDPAddr{IP: net.IPv4zero, Port: dhcpv4.ServerPort}, s.handle)
+	if err != nil {
+		return err
+	}
+	s.server = server
+	go s.server.Serve()
+	return nil
+}
+
+func (s *dhcpServer) stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// mustCheckDhcpServerSubnet refuses a DHCP server subnet that overlaps any of the host's routes (other than the server
+// port's own). The server port is on the host, so its address adds the subnet to the host's routes, which must not
+// take over traffic the host sends elsewhere.
+func mustCheckDhcpServerSubnet(portName string, serverCidr string) {
+	_, subnet, err := net.ParseCIDR(serverCidr)
+	if err != nil {
+		panic(err)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		panic(fmt.Errorf("cannot list host routes: %v", err))
+	}
+	portIndex := 0
+	if link, err := netlink.LinkByName(portName); err == nil {
+		portIndex = link.Attrs().Index
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.LinkIndex == portIndex {
+			continue
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		if route.Dst.Contains(subnet.IP) || subnet.Contains(route.Dst.IP) {
+			panic(fmt.Errorf("DHCP server subnet %s overlaps host route %s", subnet, route.Dst))
+		}
+	}
+}
+
+// mustAddDhcpServerPort adds an OVS internal port for a network's DHCP server (or returns the existing one, if restoring).
+func (d *Driver) mustAddDhcpServerPort(networkID string, ns NetworkState) (string, OFPortType) {
+	portName := dhcpServerPortName(networkID)
+	mustCheckDhcpServerSubnet(portName, ns.DHCPServer)
+	ofPort, err := d.ovsdber.getOfPort(portName)
+	if err != nil || ofPort == 0 {
+		ofPort = d.ovsdber.mustLowestFreePortOnBridge(ns.BridgeName)
+		mustVsCtl("--may-exist", "add-port", ns.BridgeName, portName, "--", "set", "Interface", portName, "type=internal", fmt.Sprintf("ofport_request=%d", ofPort))
+	}
+	mustSetInterfaceMTU(portName, ns.MTU)
+	if err := setInterfaceIP(portName, ns.DHCPServer); err != nil && !errors.Is(err, syscall.EEXIST) {
+		panic(err)
+	}
+	if err := interfaceUp(portName); err != nil {
+		panic(err)
+	}
+	return portName, ofPort
+}
+
+// startDhcpServer starts a flat network's DHCP server, if configured.
+func (d *Driver) startDhcpServer(networkID string, ns NetworkState) {
+	if ns.DHCPServer == "" {
+		return
+	}
+	d.stopDhcpServer(networkID)
+	s, err := newDhcpServer(networkID, ns)
+	if err != nil {
+		log.Errorf("cannot configure DHCP server on %s: %v", ns.BridgeName, err)
+		return
+	}
+	if err := s.start(); err != nil {
+		log.Errorf("cannot start DHCP server on %s: %v", ns.BridgeName, err)
+		return
+	}
+	log.Infof("DHCP server for %s on %s, leasing %s-%s", ns.BridgeName, s.portName, s.rangeStart, s.rangeEnd)
+	d.dhcpServers[networkID] = s
+}
+
+func (d *Driver) stopDhcpServer(networkID string) {
+	s, ok := d.dhcpServers[networkID]
+	if !ok {
+		return
+	}
+	s.stop()
+	delete(d.dhcpServers, networkID)
+}
+
+// getDhcpReservation returns the address reserved for a container by label, if any.
+func getDhcpReservation(ns NetworkState, labels map[string]string) (net.IP, error) {
+	label, ok := labels["dovesnap.dhcp.ip"]
+	if !ok {
+		return nil, nil
+	}
+	ipStr := getStrForNetwork(label, ns.NetworkName)
+	if ipStr == "" {
+		return nil, nil
+	}
+	return parseIPv4(ipStr)
+}
+
+// reconcileDhcpLeases copies DHCP server leases into network state, for the status API.
+func reconcileDhcpLeases(d *Driver) {
+	for id, ns := range d.networks {
+		s, ok := d.dhcpServers[id]
+		if !ok {
+			continue
+		}
+		leases := s.activeLeases()
+		for mac := range ns.DynamicNetworkStates.DHCPLeases {
+			if _, ok := leases[mac]; !ok {
+				delete(ns.DynamicNetworkStates.DHCPLeases, mac)
+			}
+		}
+		for mac, lease := range leases {
+			ns.DynamicNetworkStates.DHCPLeases[mac] = lease
+		}
+	}
+}
+
+// reconcileDhcpServerAddresses records the addresses dovesnap's DHCP servers have leased to containers, and updates
+// port security and policy ACLs when they change.
+func reconcileDhcpServerAddresses(d *Driver) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("reconcileDhcpServerAddresses failed: %v", rerr)
+		}
+	}()
+
+	for id, ns := range d.networks {
+		s, ok := d.dhcpServers[id]
+		if !ok {
+			continue
+		}
+		leases := s.activeLeases()
+		changed := false
+		for endpointID, containerState := range ns.DynamicNetworkStates.Containers {
+			ip := leases[mustParseMAC(containerState.MacAddress)].IP
+			if ip == containerState.DHCPServerIP {
+				continue
+			}
+			containerState.DHCPServerIP = ip
+			ns.DynamicNetworkStates.Containers[endpointID] = containerState
+			if containerState.PortSecurityAcl != "" {
+				d.mustSetPortSecurityAcl(id, endpointID, containerState)
+			}
+			changed = true
+		}
+		if changed {
+			d.updateDNS(id)
+			compilePolicies(d, id)
+		}
+	}
+}
+
+func mustParseMAC(macAddress string) string {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		panic(err)
+	}
+	return mac.String()
+}
@@ -0,0 +1,392 @@
+package ovs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPort        = "53"
+	dnsTTL         = 60
+	dnsTimeout     = 2 * time.Second
+	dnsMaxMsgSize  = 65535
+	dnsMaxQueries  = 64
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+// dnsServer answers queries for a network's container names on the network's gateway(s), and forwards other queries upstream.
+type dnsServer struct {
+	mu        sync.RWMutex
+	records   map[string][]net.IP
+	upstreams []string
+	// clients are the network's subnets, from which queries are answered (others are dropped, so the server is not an
+	// open resolver on a gateway reachable from outside).
+	clients   []*net.IPNet
+	conns     []net.PacketConn
+	listeners []net.Listener
+	// queries limits the number of queries being answered at once (excess queries are dropped).
+	queries chan struct{}
+}
+
+// getResolvConfNameservers returns the host's nameservers.
+func getResolvConfNameservers() []string {
+	nameservers := []string{}
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nameservers
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	return nameservers
+}
+
+// getDNSUpstreams returns the upstream servers for a network, which must not be the network's own gateway(s).
+func getDNSUpstreams(ns NetworkState) ([]string, error) {
+	nameservers := getResolvConfNameservers()
+	if ns.DNSUpstream != "" {
+		nameservers = strings.Split(ns.DNSUpstream, ",")
+	}
+	gateways := map[string]bool{ns.Gateway: true, ns.Gateway6: true}
+	upstreams := []string{}
+	for _, nameserver := range nameservers {
+		nameserver = strings.TrimSpace(nameserver)
+		if net.ParseIP(nameserver) == nil {
+			return nil, fmt.Errorf("invalid DNS upstream %s", nameserver)
+		}
+		if gateways[nameserver] {
+			continue
+		}
+		upstreams = append(upstreams, net.JoinHostPort(nameserver, dnsPort))
+	}
+	return upstreams, nil
+}
+
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// getDNSRecords returns the addresses of each container on a network, by name and alias (and qualified by the network's name).
+func getDNSRecords(ns NetworkState) map[string][]net.IP {
+	records := make(map[string][]net.IP)
+	for _, container := range ns.DynamicNetworkStates.Containers {
+		ips := []net.IP{}
+		for _, ip := range getContainerIPs(container) {
+			if !slices.ContainsFunc(ips, ip.Equal) {
+				ips = append(ips, ip)
+			}
+		}
+		names := append([]string{strings.TrimPrefix(container.Name, "/")}, container.Aliases...)
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			records[dnsName(name)] = append(records[dnsName(name)], ips...)
+			records[dnsName(name+"."+ns.NetworkName)] = append(records[dnsName(name+"."+ns.NetworkName)], ips...)
+		}
+	}
+	return records
+}
+
+func (s *dnsServer) setRecords(records map[string][]net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+func (s *dnsServer) lookup(name string) ([]net.IP, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ips, ok := s.records[dnsName(name)]
+	return ips, ok
+}
+
+// answer returns a response for a query, from the network's records, if the name is a container on the network.
+func (s *dnsServer) answer(header dnsmessage.Header, q dnsmessage.Question) ([]byte, bool, error) {
+	ips, ok := s.lookup(q.Name.String())
+	if !ok {
+		return nil, false, nil
+	}
+	header.Response = true
+	header.Authoritative = true
+	header.RecursionAvailable = true
+	header.RCode = dnsmessage.RCodeSuccess
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, true, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, true, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, true, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	for _, ip := range ips {
+		var err error
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			r := dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			err = b.AResource(rh, r)
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			r := dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			err = b.AAAAResource(rh, r)
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	msg, err := b.Finish()
+	return msg, true, err
+}
+
+func dnsServerFailure(header dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	header.Response = true
+	header.RCode = dnsmessage.RCodeServerFailure
+	msg := dnsmessage.Message{Header: header, Questions: []dnsmessage.Question{q}}
+	return msg.Pack()
+}
+
+func readTCPMsg(conn net.Conn) ([]byte, error) {
+	var msgLen uint16
+	if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, msgLen)
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func writeTCPMsg(conn net.Conn, msg []byte) error {
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// forward sends a query to each upstream in turn, until one answers.
+func (s *dnsServer) forward(query []byte, tcp bool) ([]byte, error) {
+	err := fmt.Errorf("no DNS upstreams")
+	for _, upstream := range s.upstreams {
+		var conn net.Conn
+		var resp []byte
+		if tcp {
+			conn, err = net.DialTimeout("tcp", upstream, dnsTimeout)
+		} else {
+			conn, err = net.DialTimeout("udp", upstream, dnsTimeout)
+		}
+		if err != nil {
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		if tcp {
+			if err = writeTCPMsg(conn, query); err == nil {
+				resp, err = readTCPMsg(conn)
+			}
+		} else if _, err = conn.Write(query); err == nil {
+			buf := make([]byte, dnsMaxMsgSize)
+			var n int
+			n, err = conn.Read(buf)
+			resp = buf[:n]
+		}
+		conn.Close()
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// respond returns the response to a query, or nil if it should be ignored.
+func (s *dnsServer) respond(query []byte, tcp bool) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	resp, local, err := s.answer(header, q)
+	if !local {
+		resp, err = s.forward(query, tcp)
+	}
+	if err != nil {
+		log.Debugf("cannot resolve %s: %v", q.Name, err)
+		if resp, err = dnsServerFailure(header, q); err != nil {
+			return nil
+		}
+	}
+	return resp
+}
+
+func (s *dnsServer) allowedClient(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, client := range s.clients {
+		if ip != nil && client.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, dnsMaxMsgSize)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !s.allowedClient(peer) {
+			log.Debugf("dropping DNS query from %s: not on the network", peer)
+			continue
+		}
+		select {
+		case s.queries <- struct{}{}:
+		default:
+			log.Debugf("dropping DNS query from %s: too many queries", peer)
+			continue
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			defer func() { <-s.queries }()
+			if resp := s.respond(query, false); resp != nil {
+				conn.WriteTo(resp, peer)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.allowedClient(conn.RemoteAddr()) {
+			log.Debugf("dropping DNS connection from %s: not on the network", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		select {
+		case s.queries <- struct{}{}:
+		default:
+			log.Debugf("dropping DNS connection from %s: too many queries", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-s.queries }()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(dnsTimeout * 2))
+			query, err := readTCPMsg(conn)
+			if err != nil {
+				return
+			}
+			if resp := s.respond(query, true); resp != nil {
+				writeTCPMsg(conn, resp)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) stop() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+}
+
+func startDNSServer(ns NetworkState) (*dnsServer, error) {
+	upstreams, err := getDNSUpstreams(ns)
+	if err != nil {
+		return nil, err
+	}
+	s := &dnsServer{
+		records:   getDNSRecords(ns),
+		upstreams: upstreams,
+		queries:   make(chan struct{}, dnsMaxQueries),
+	}
+	for _, cidr := range getGatewayCidrs(ns) {
+		if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+			s.clients = append(s.clients, subnet)
+		}
+	}
+	for _, gateway := range []string{ns.Gateway, ns.Gateway6} {
+		if gateway == "" {
+			continue
+		}
+		addr := net.JoinHostPort(gateway, dnsPort)
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			s.stop()
+			return nil, err
+		}
+		s.conns = append(s.conns, conn)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.stop()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, listener)
+		go s.serveUDP(conn)
+		go s.serveTCP(listener)
+	}
+	return s, nil
+}
+
+// startDNS starts a NAT or routed network's DNS server, if configured.
+func (d *Driver) startDNS(networkID string, ns NetworkState) {
+	if !ns.DNS {
+		return
+	}
+	d.stopDNS(networkID)
+	s, err := startDNSServer(ns)
+	if err != nil {
+		log.Errorf("cannot start DNS server on %s: %v", ns.BridgeName, err)
+		return
+	}
+	log.Infof("DNS server for %s on %s, forwarding to %s", ns.NetworkName, strings.Join(getGatewayCidrs(ns), ","), strings.Join(s.upstreams, ","))
+	d.dnsServers[networkID] = s
+}
+
+func (d *Driver) stopDNS(networkID string) {
+	s, ok := d.dnsServers[networkID]
+	if !ok {
+		return
+	}
+	s.stop()
+	delete(d.dnsServers, networkID)
+}
+
+// updateDNS updates a network's DNS records, after a container joins or leaves, or its addresses change.
+func (d *Driver) updateDNS(networkID string) {
+	s, ok := d.dnsServers[networkID]
+	if !ok {
+		return
+	}
+	s.setRecords(getDNSRecords(d.networks[networkID]))
+}
@@ -65,6 +65,41 @@ func (c *dockerer) mustGetNetworkList() map[string]string {
 	return netlist
 }
 
+func (c *dockerer) mustGetAllNetworks() []network.Summary {
+	networkList, err := c.client.NetworkList(context.Background(), network.ListOptions{})
+	if err != nil {
+		panic(fmt.Errorf("could not get docker networks: %s", err))
+	}
+	return networkList
+}
+
+// mustGetAllContainerIDs returns the IDs of all containers, including stopped ones (like docker ps -a).
+func (c *dockerer) mustGetAllContainerIDs() map[string]bool {
+	containerList, err := c.client.ContainerList(context.Background(), container.ListOptions{All: true})
+	if err != nil {
+		panic(fmt.Errorf("could not get docker containers: %s", err))
+	}
+	containerIDs := make(map[string]bool)
+	for _, summary := range containerList {
+		containerIDs[summary.ID] = true
+	}
+	return containerIDs
+}
+
+func (c *dockerer) mustKillContainer(containerID string) {
+	err := c.client.ContainerKill(context.Background(), containerID, "KILL")
+	if err != nil {
+		panic(fmt.Errorf("could not kill container %s: %s", containerID, err))
+	}
+}
+
+func (c *dockerer) mustRemoveNetwork(NetworkID string) {
+	err := c.client.NetworkRemove(context.Background(), NetworkID)
+	if err != nil {
+		panic(fmt.Errorf("could not remove network %s: %s", NetworkID, err))
+	}
+}
+
 func (c *dockerer) getContainerFromEndpoint(NetworkID string, EndpointID string) (container.InspectResponse, error) {
 	for i := 0; i < dockerRetries; i++ {
 		log.Debugf("about to inspect network %+v", NetworkID)
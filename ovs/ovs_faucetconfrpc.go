@@ -14,12 +14,60 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
 )
 
 type faucetconfrpcer struct {
 	client faucetconfserver.FaucetConfServerClient
 }
 
+// faucetVlanConfig is the part of FAUCET's config that defines and uses VLANs.
+type faucetVlanConfig struct {
+	Vlans map[string]struct {
+		Vid *uint `yaml:"vid"`
+	} `yaml:"vlans"`
+	Dps map[string]struct {
+		Interfaces map[string]struct {
+			NativeVlan  string   `yaml:"native_vlan"`
+			TaggedVlans []string `yaml:"tagged_vlans"`
+		} `yaml:"interfaces"`
+	} `yaml:"dps"`
+}
+
+// faucetAclNames is an ACL name, or a list of them.
+type faucetAclNames []string
+
+func (a *faucetAclNames) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*a = faucetAclNames{value.Value}
+		return nil
+	}
+	names := []string{}
+	if err := value.Decode(&names); err != nil {
+		return err
+	}
+	*a = names
+	return nil
+}
+
+// faucetAclConfig is the part of FAUCET's config that defines and uses ACLs.
+type faucetAclConfig struct {
+	Acls  map[string]interface{} `yaml:"acls"`
+	Vlans map[string]struct {
+		AclsIn  faucetAclNames `yaml:"acls_in"`
+		AclIn   faucetAclNames `yaml:"acl_in"`
+		AclsOut faucetAclNames `yaml:"acls_out"`
+		AclOut  faucetAclNames `yaml:"acl_out"`
+	} `yaml:"vlans"`
+	Dps map[string]struct {
+		DpAcls     faucetAclNames `yaml:"dp_acls"`
+		Interfaces map[string]struct {
+			AclsIn faucetAclNames `yaml:"acls_in"`
+			AclIn  faucetAclNames `yaml:"acl_in"`
+		} `yaml:"interfaces"`
+	} `yaml:"dps"`
+}
+
 func (c *faucetconfrpcer) mustGetGRPCClient(flagFaucetconfrpcClientName string, flagFaucetconfrpcServerName string, flagFaucetconfrpcServerPort int, flagFaucetconfrpcKeydir string, flagFaucetconfrpcConnRetries int) {
 	crt_file := fmt.Sprintf("%s/%s.crt", flagFaucetconfrpcKeydir, flagFaucetconfrpcClientName)
 	key_file := fmt.Sprintf("%s/%s.key", flagFaucetconfrpcKeydir, flagFaucetconfrpcClientName)
@@ -81,6 +129,84 @@ func (c *faucetconfrpcer) getDpNames() map[string]bool {
 	return dpNames
 }
 
+func (c *faucetconfrpcer) mustGetDpInfo(dpName string) []*faucetconfserver.DpInfo {
+	req := &faucetconfserver.GetDpInfoRequest{
+		DpName: dpName,
+	}
+	resp, err := c.client.GetDpInfo(context.Background(), req)
+	if err != nil {
+		panic(err)
+	}
+	return resp.Dps
+}
+
+func (c *faucetconfrpcer) mustGetFaucetConfigFile() string {
+	req := &faucetconfserver.GetConfigFileRequest{}
+	resp, err := c.client.GetConfigFile(context.Background(), req)
+	if err != nil {
+		panic(err)
+	}
+	return resp.ConfigYaml
+}
+
+// mustGetDpVlans returns the VIDs of the VLANs FAUCET defines, and the VLANs used by a DP's interfaces.
+func (c *faucetconfrpcer) mustGetDpVlans(dpName string) map[uint]bool {
+	config := faucetVlanConfig{}
+	if err := yaml.Unmarshal([]byte(c.mustGetFaucetConfigFile()), &config); err != nil {
+		panic(fmt.Errorf("cannot parse FAUCET config: %v", err))
+	}
+	vlans := make(map[uint]bool)
+	vlanVid := func(vlan string) {
+		if vlanConfig, ok := config.Vlans[vlan]; ok && vlanConfig.Vid != nil {
+			vlans[*vlanConfig.Vid] = true
+		} else if vid, err := strconv.ParseUint(vlan, 10, 16); err == nil {
+			vlans[uint(vid)] = true
+		}
+	}
+	for vlan := range config.Vlans {
+		vlanVid(vlan)
+	}
+	for _, iface := range config.Dps[dpName].Interfaces {
+		vlanVid(iface.NativeVlan)
+		for _, vlan := range iface.TaggedVlans {
+			vlanVid(vlan)
+		}
+	}
+	return vlans
+}
+
+// mustGetUnusedAcls returns the ACLs FAUCET defines, that no DP, interface or VLAN uses.
+func (c *faucetconfrpcer) mustGetUnusedAcls() []string {
+	config := faucetAclConfig{}
+	if err := yaml.Unmarshal([]byte(c.mustGetFaucetConfigFile()), &config); err != nil {
+		panic(fmt.Errorf("cannot parse FAUCET config: %v", err))
+	}
+	used := make(map[string]bool)
+	use := func(aclsList ...faucetAclNames) {
+		for _, acls := range aclsList {
+			for _, acl := range acls {
+				used[acl] = true
+			}
+		}
+	}
+	for _, vlan := range config.Vlans {
+		use(vlan.AclsIn, vlan.AclIn, vlan.AclsOut, vlan.AclOut)
+	}
+	for _, dp := range config.Dps {
+		use(dp.DpAcls)
+		for _, iface := range dp.Interfaces {
+			use(iface.AclsIn, iface.AclIn)
+		}
+	}
+	unused := []string{}
+	for acl := range config.Acls {
+		if !used[acl] {
+			unused = append(unused, acl)
+		}
+	}
+	return unused
+}
+
 func (c *faucetconfrpcer) mustSetFaucetConfigFile(config_yaml string) {
 	log.Debugf("setFaucetConfigFile %s", config_yaml)
 	req := &faucetconfserver.SetConfigFileRequest{
@@ -93,6 +219,15 @@ func (c *faucetconfrpcer) mustSetFaucetConfigFile(config_yaml string) {
 	}
 }
 
+// deleteConfigKeys deletes config, e.g. [acls, myacl] deletes {acls: {myacl}}.
+func (c *faucetconfrpcer) deleteConfigKeys(configYamlKeys string) error {
+	req := &faucetconfserver.DelConfigFromFileRequest{
+		ConfigYamlKeys: configYamlKeys,
+	}
+	_, err := c.client.DelConfigFromFile(context.Background(), req)
+	return err
+}
+
 func (c *faucetconfrpcer) mustSetPortAcl(dpName string, portNo OFPortType, acls string) {
 	req := &faucetconfserver.SetPortAclRequest{
 		DpName: dpName,
@@ -116,7 +251,7 @@ func (c *faucetconfrpcer) mustSetVlanOutAcl(vlan_name string, acl_out string) {
 	}
 }
 
-func (c *faucetconfrpcer) mustDeleteDpInterface(dpName string, ofport OFPortType) {
+func (c *faucetconfrpcer) deleteDpInterface(dpName string, ofport OFPortType) error {
 	interfaces := &faucetconfserver.InterfaceInfo{
 		PortNo: uint32(ofport),
 	}
@@ -133,6 +268,11 @@ func (c *faucetconfrpcer) mustDeleteDpInterface(dpName string, ofport OFPortType
 	}
 
 	_, err := c.client.DelDpInterfaces(context.Background(), req)
+	return err
+}
+
+func (c *faucetconfrpcer) mustDeleteDpInterface(dpName string, ofport OFPortType) {
+	err := c.deleteDpInterface(dpName, ofport)
 	if err != nil {
 		panic(err)
 	}
@@ -166,6 +306,18 @@ func (c *faucetconfrpcer) mustAddPortMirror(dpName string, ofport OFPortType, mi
 	}
 }
 
+func (c *faucetconfrpcer) mustRemovePortMirror(dpName string, ofport OFPortType, mirrorofport OFPortType) {
+	req := &faucetconfserver.RemovePortMirrorRequest{
+		DpName:       dpName,
+		PortNo:       uint32(ofport),
+		MirrorPortNo: uint32(mirrorofport),
+	}
+	_, err := c.client.RemovePortMirror(context.Background(), req)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func (c *faucetconfrpcer) mustSetRemoteMirrorPort(dpName string, ofport OFPortType, vid OFVidType, remoteDpName string, remoteofport OFPortType) {
 	req := &faucetconfserver.SetRemoteMirrorPortRequest{
 		DpName:       dpName,
@@ -188,6 +340,23 @@ func (c *faucetconfrpcer) vlanInterfaceYaml(ofport OFPortType, description strin
 	return fmt.Sprintf("%d: {description: %s, native_vlan: %d, acls_in: [%s]},", ofport, description, vlan, acls_in)
 }
 
+func (c *faucetconfrpcer) taggedVlanInterfaceYaml(ofport OFPortType, description string, vlan uint, taggedVlans []uint, acls_in string) string {
+	return fmt.Sprintf("%d: {description: %s, native_vlan: %d, tagged_vlans: [%s], acls_in: [%s]},", ofport, description, vlan, formatVLANs(taggedVlans), acls_in)
+}
+
+const allowAllAcl = "dovesnap-allow-all"
+
+// allowAllAclYaml returns an ACL that allows all traffic.
+func (c *faucetconfrpcer) allowAllAclYaml() string {
+	return fmt.Sprintf("{acls: {%s: [{rule: {actions: {allow: 1}}}]}}", allowAllAcl)
+}
+
+// rateMeterYaml returns a meter, and an ACL of the same name that applies it to all traffic.
+func (c *faucetconfrpcer) rateMeterYaml(meterName string, meterID OFPortType, kbps uint64) string {
+	return fmt.Sprintf("{meters: {%s: {meter_id: %d, entry: {flags: [KBPS], bands: [{type: DROP, rate: %d}]}}}, acls: {%s: [{rule: {actions: {meter: %s, allow: 1}}}]}}",
+		meterName, meterID, kbps, meterName, meterName)
+}
+
 func (c *faucetconfrpcer) localVlanInterfaceYaml(ofport OFPortType, description string, vlan uint, acls_in string) string {
 	return fmt.Sprintf("%d: {opstatus_reconf: False, description: %s, native_vlan: %d, acls_in: [%s]},", ofport, description, vlan, acls_in)
 }
@@ -0,0 +1,121 @@
+package ovs
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	firewallAuto     = "auto"
+	firewallIptables = "iptables"
+	firewallNftables = "nftables"
+)
+
+// egressConfig is how traffic from a NAT or routed network is forwarded out of the host.
+type egressConfig struct {
+	BridgeName string
+	Cidr       string
+	NAT        bool
+	// Optional: forward (and NAT) only out of this interface.
+	OutIface string
+	// Optional: SNAT to this address, rather than masquerading.
+	NATSource string
+}
+
+// getEgressConfigs returns the egress config for each of a network's address families.
+func getEgressConfigs(ns NetworkState) []egressConfig {
+	egs := []egressConfig{}
+	for _, cidr := range getGatewayCidrs(ns) {
+		natSource := ""
+		if ns.NATSource != "" && ipFamily(ns.NATSource) == ipFamily(cidr) {
+			natSource = ns.NATSource
+		}
+		egs = append(egs, egressConfig{
+			BridgeName: ns.BridgeName,
+			Cidr:       cidr,
+			NAT:        ns.Mode == modeNAT,
+			OutIface:   ns.FlatBindInterface,
+			NATSource:  natSource,
+		})
+	}
+	return egs
+}
+
+// firewaller programs NAT and port maps for dovesnap networks.
+type firewaller interface {
+	egress(eg egressConfig, add bool) error
+	mustAddPortMap(bridgeName string, pm PortMap)
+	mustDeletePortMap(bridgeName string, pm PortMap)
+	// reconcile replaces dovesnap's rules with the expected state, if they have drifted from it (or always, if forced).
+	reconcile(state firewallState, force bool) (bool, error)
+}
+
+// firewallState is the egress rules and port maps dovesnap should have programmed.
+type firewallState struct {
+	egresses []egressConfig
+	portMaps map[string][]PortMap
+}
+
+func getFirewallState(d *Driver, OFPorts *map[string]OFPortContainer) firewallState {
+	state := firewallState{
+		egresses: []egressConfig{},
+		portMaps: make(map[string][]PortMap),
+	}
+	for _, ns := range d.networks {
+		if ns.Mode == modeNAT || ns.Mode == modeRouted {
+			state.egresses = append(state.egresses, getEgressConfigs(ns)...)
+		}
+	}
+	for _, containerMap := range *OFPorts {
+		ns, ok := d.networks[containerMap.NetworkID]
+		if !ok || len(containerMap.portMaps) == 0 {
+			continue
+		}
+		state.portMaps[ns.BridgeName] = append(state.portMaps[ns.BridgeName], containerMap.portMaps...)
+	}
+	return state
+}
+
+// reconcileFirewall restores dovesnap's egress and port map rules, if they have been removed
+// or changed by something else (e.g. docker, or a firewall service restart).
+func reconcileFirewall(d *Driver, OFPorts *map[string]OFPortContainer, force bool) {
+	repaired, err := d.firewall.reconcile(getFirewallState(d, OFPorts), force)
+	if err != nil {
+		log.Errorf("cannot reconcile firewall rules: %v", err)
+		return
+	}
+	if repaired && !force {
+		log.Warnf("firewall rules drifted, restored")
+	}
+}
+
+// detectFirewallBackend returns iptables if docker is using (legacy) iptables, otherwise nftables if available.
+func detectFirewallBackend() string {
+	if _, err := iptablesRaw(false, "-t", "nat", "-S", "DOCKER"); err == nil {
+		return firewallIptables
+	}
+	conn, err := nftables.New()
+	if err != nil {
+		return firewallIptables
+	}
+	if _, err := conn.ListTables(); err != nil {
+		return firewallIptables
+	}
+	return firewallNftables
+}
+
+func mustGetFirewaller(backend string) firewaller {
+	if backend == firewallAuto {
+		backend = detectFirewallBackend()
+	}
+	log.Infof("using %s firewall backend", backend)
+	switch backend {
+	case firewallIptables:
+		return mustGetIptablesFirewall()
+	case firewallNftables:
+		return mustGetNftablesFirewall()
+	}
+	panic(fmt.Errorf("unknown firewall backend %s", backend))
+}
@@ -0,0 +1,187 @@
+package ovs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	gcPort = "port"
+	gcVeth = "veth"
+	gcAcl  = "acl"
+	// gcConfirmDelay is the longest time before suspects are confirmed orphaned (and collected).
+	gcConfirmDelay = 30 * time.Second
+)
+
+// gcCandidate is an endpoint resource that no longer has an endpoint.
+type gcCandidate struct {
+	Kind      string
+	Name      string
+	NetworkID string
+	OFPort    OFPortType
+}
+
+func (c gcCandidate) key() string {
+	return c.Kind + ":" + c.Name
+}
+
+// mustGetLiveEndpoints returns truncated endpoint IDs, that docker or dovesnap are using.
+func (d *Driver) mustGetLiveEndpoints(OFPorts *map[string]OFPortContainer) map[string]bool {
+	endpoints := make(map[string]bool)
+	for endpointID := range *OFPorts {
+		endpoints[truncateID(endpointID)] = true
+	}
+	for id := range d.networks {
+		netInspect := d.dockerer.mustGetNetworkInspectFromID(id)
+		for _, endpoint := range netInspect.Containers {
+			endpoints[truncateID(endpoint.EndpointID)] = true
+		}
+	}
+	return endpoints
+}
+
+func (d *Driver) getGCCandidates(OFPorts *map[string]OFPortContainer) []gcCandidate {
+	candidates := []gcCandidate{}
+	endpoints := d.mustGetLiveEndpoints(OFPorts)
+
+	for id, ns := range d.networks {
+		portDesc := make(map[OFPortType]string)
+		if err := scrapePortDesc(ns.BridgeName, &portDesc); err != nil {
+			log.Warnf("scrape of port-desc for %s failed, will retry GC", ns.BridgeName)
+			continue
+		}
+		for ofPort, desc := range portDesc {
+			if !strings.HasPrefix(desc, ovsPortPrefix) || endpoints[strings.TrimPrefix(desc, ovsPortPrefix)] {
+				continue
+			}
+			candidates = append(candidates, gcCandidate{Kind: gcPort, Name: desc, NetworkID: id, OFPort: ofPort})
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Warnf("cannot list links for GC: %v", err)
+	} else {
+		for _, link := range links {
+			linkName := link.Attrs().Name
+			if link.Type() != "veth" || !strings.HasPrefix(linkName, ovsPortPrefix) {
+				continue
+			}
+			if endpoints[strings.TrimPrefix(linkName, ovsPortPrefix)] {
+				continue
+			}
+			candidates = append(candidates, gcCandidate{Kind: gcVeth, Name: linkName})
+		}
+	}
+
+	ownedAcls := d.getOwnedAcls()
+	for _, acl := range d.faucetconfrpcer.mustGetUnusedAcls() {
+		if !isDovesnapAcl(acl) || ownedAcls[acl] {
+			continue
+		}
+		candidates = append(candidates, gcCandidate{Kind: gcAcl, Name: acl})
+	}
+	return candidates
+}
+
+func (d *Driver) mustCollect(candidate gcCandidate) {
+	switch candidate.Kind {
+	case gcPort:
+		ns := d.networks[candidate.NetworkID]
+		d.ovsdber.mustDeletePort(ns.BridgeName, candidate.Name)
+		d.faucetconfrpcer.mustDeleteDpInterface(ns.NetworkName, candidate.OFPort)
+	case gcVeth:
+		link, err := netlink.LinkByName(candidate.Name)
+		if err != nil {
+			// Already gone, e.g. with its OVS port.
+			return
+		}
+		if err = netlink.LinkDel(link); err != nil {
+			panic(err)
+		}
+	case gcAcl:
+		delete(d.faucetAcls, candidate.Name)
+		delete(d.portSecurityRules, candidate.Name)
+		if err := d.faucetconfrpcer.deleteConfigKeys(fmt.Sprintf("[acls, %s]", candidate.Name)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (d *Driver) collect(candidate gcCandidate) (err error) {
+	err = nil
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			err = fmt.Errorf("cannot collect %s %s: %v", candidate.Kind, candidate.Name, rerr)
+		}
+	}()
+	d.mustCollect(candidate)
+	return err
+}
+
+// collectGarbage removes OVS ports and veths left behind by endpoints
+// that neither docker nor dovesnap know about, and dovesnap's FAUCET ACLs that no
+// network or container owns (and nothing in FAUCET uses). A resource must be found
+// orphaned on two consecutive runs before it is collected, so that endpoints in the
+// middle of CreateEndpoint() (veth created, port not yet reserved) are not collected.
+// Overrides of containers that docker no longer has are also removed.
+func collectGarbage(d *Driver, OFPorts *map[string]OFPortContainer) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("collectGarbage failed: %v", rerr)
+		}
+	}()
+
+	suspects := make(map[string]bool)
+	collected := 0
+	for _, candidate := range d.getGCCandidates(OFPorts) {
+		if !d.gcSuspects[candidate.key()] {
+			log.Debugf("GC suspect %s %s", candidate.Kind, candidate.Name)
+			suspects[candidate.key()] = true
+			continue
+		}
+		if err := d.collect(candidate); err != nil {
+			log.Warnf("%v", err)
+			continue
+		}
+		collected++
+		log.Infof("GC collected %s %s", candidate.Kind, candidate.Name)
+		details := map[string]string{
+			"kind": candidate.Kind,
+			"name": candidate.Name,
+		}
+		ns := NetworkState{}
+		if candidate.Kind == gcPort {
+			ns = d.networks[candidate.NetworkID]
+			details["port"] = fmt.Sprintf("%d", candidate.OFPort)
+		}
+		d.notifyMsgChan <- NotifyMsg{
+			Type:         "GC",
+			Operation:    "COLLECT",
+			NetworkState: ns,
+			Details:      details,
+		}
+	}
+	d.gcSuspects = suspects
+	d.lastGC = time.Now()
+	if collected > 0 {
+		log.Infof("GC collected %d orphaned resources", collected)
+	}
+	d.mustPruneContainerOverrides()
+}
+
+func gcDue(d *Driver) bool {
+	// Confirm suspects sooner than the next interval (even if only collecting at startup), otherwise wait for it.
+	if len(d.gcSuspects) > 0 {
+		confirmDelay := gcConfirmDelay
+		if d.gcInterval > 0 && d.gcInterval < confirmDelay {
+			confirmDelay = d.gcInterval
+		}
+		return time.Since(d.lastGC) >= confirmDelay
+	}
+	return d.gcInterval > 0 && time.Since(d.lastGC) >= d.gcInterval
+}
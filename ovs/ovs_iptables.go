@@ -1,51 +1,569 @@
 package ovs
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
-	"github.com/docker/libnetwork/iptables"
+	"github.com/docker/docker/api/types/network"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
-func mustIptablesRaw(args ...string) []byte {
-	output, err := iptables.Raw(args...)
+const (
+	dovesnapNatChain  = "DOVESNAP-NAT"
+	dovesnapDnatChain = "DOVESNAP-DNAT"
+	dovesnapFwdChain  = "DOVESNAP-FWD"
+)
+
+// iptablesRule is a rule in one of dovesnap's own chains.
+type iptablesRule struct {
+	ipv6  bool
+	table string
+	chain string
+	args  []string
+}
+
+// iptablesJumps are the jumps from the built in chains to dovesnap's chains.
+var iptablesJumps = []iptablesRule{
+	{table: "nat", chain: "POSTROUTING", args: []string{"-j", dovesnapNatChain}},
+	{table: "nat", chain: "PREROUTING", args: []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", dovesnapDnatChain}},
+	{table: "nat", chain: "OUTPUT", args: []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", dovesnapDnatChain}},
+	{table: "filter", chain: "FORWARD", args: []string{"-j", dovesnapFwdChain}},
+}
+
+// iptablesChains are dovesnap's chains, by table.
+var iptablesChains = []iptablesRule{
+	{table: "nat", chain: dovesnapNatChain},
+	{table: "nat", chain: dovesnapDnatChain},
+	{table: "filter", chain: dovesnapFwdChain},
+}
+
+// iptablesMutatingOps are the operations that print nothing when they succeed.
+var iptablesMutatingOps = map[string]bool{"-A": true, "-I": true, "-D": true, "-N": true, "-F": true, "-X": true}
+
+// iptablesRaw runs iptables or ip6tables (waiting for the xtables lock), and returns its output. Output from a
+// mutating operation is an error, even if iptables exits successfully.
+func iptablesRaw(ipv6 bool, args ...string) (string, error) {
+	cmd := "iptables"
+	if ipv6 {
+		cmd = "ip6tables"
+	}
+	output, err := RunCmd(cmd, append([]string{"--wait"}, args...)...)
+	if err == nil && len(output) > 0 {
+		for _, arg := range args {
+			if iptablesMutatingOps[arg] {
+				err = fmt.Errorf("%s", output)
+				break
+			}
+		}
+	}
+	return output, err
+}
+
+func (r iptablesRule) run(op string) error {
+	args := append([]string{"-t", r.table, op, r.chain}, r.args...)
+	if output, err := iptablesRaw(r.ipv6, args...); err != nil {
+		return fmt.Errorf("iptables %s failed: %s %v", strings.Join(args, " "), output, err)
+	}
+	return nil
+}
+
+func (r iptablesRule) exists() bool {
+	return r.run("-C") == nil
+}
+
+// iptablesFirewall programs NAT and port maps with (legacy) iptables, in dovesnap's own chains.
+type iptablesFirewall struct {
+	ipv6   bool
+	chains []iptablesRule
+	jumps  []iptablesRule
+}
+
+// newIptablesFirewall creates chains, and jumps to them. Rules for other chains are ignored.
+func newIptablesFirewall(chains []iptablesRule, jumps []iptablesRule) (*iptablesFirewall, error) {
+	f := &iptablesFirewall{chains: chains, jumps: jumps}
+	if err := f.ensureChains(false); err != nil {
+		return nil, err
+	}
+	if err := f.ensureChains(true); err != nil {
+		log.Warnf("cannot create ip6tables chains, IPv6 port maps will not be available: %v", err)
+	} else {
+		f.ipv6 = true
+	}
+	return f, nil
+}
+
+// mustGetIptablesFirewall creates dovesnap's chains, and jumps to them from the built in chains.
+func mustGetIptablesFirewall() *iptablesFirewall {
+	f, err := newIptablesFirewall(iptablesChains, iptablesJumps)
 	if err != nil {
 		panic(err)
 	}
-	return output
+	return f
 }
 
-// TODO: reconcile with what libnetwork does and port mappings
-func natOut(cidr string, op string) error {
-	masquerade := []string{
-		"POSTROUTING", "-t", "nat",
-		"-s", cidr,
-		"-j", "MASQUERADE",
+func (f *iptablesFirewall) ensureChains(ipv6 bool) error {
+	for _, chain := range f.chains {
+		if _, err := iptablesRaw(ipv6, "-t", chain.table, "-S", chain.chain); err == nil {
+			continue
+		}
+		if output, err := iptablesRaw(ipv6, "-t", chain.table, "-N", chain.chain); err != nil {
+			return fmt.Errorf("cannot create %s chain %s: %s %v", chain.table, chain.chain, output, err)
+		}
 	}
-	incl := append([]string{op}, masquerade...)
-	if output, err := iptables.Raw(incl...); err != nil {
-		return err
-	} else if len(output) > 0 {
-		return &iptables.ChainError{
-			Chain:  "POSTROUTING",
-			Output: output,
+	for _, jump := range f.jumps {
+		jump.ipv6 = ipv6
+		if jump.exists() {
+			continue
+		}
+		// Jump before docker's own rules.
+		args := append([]string{"-t", jump.table, "-I", jump.chain, "1"}, jump.args...)
+		if output, err := iptablesRaw(ipv6, args...); err != nil {
+			return fmt.Errorf("cannot add jump to %s: %s %v", jump.chain, output, err)
 		}
 	}
-	_, err := iptables.Raw("-P", "FORWARD", "ACCEPT")
-	return err
+	return nil
 }
 
-func mustPortMap(op string, bridgeName string, ipProto string, gatewayIP string, hostIP string, hostPort string, port string) {
-	dst := fmt.Sprintf("%s:%s", hostIP, port)
-	mustIptablesRaw("-t", "nat", op, "DOCKER", "-p", ipProto, "-d", gatewayIP, "--dport", hostPort, "-j", "DNAT", "--to-destination", dst)
-	mustIptablesRaw("-t", "nat", op, "OUTPUT", "-p", ipProto, "-d", gatewayIP, "--dport", hostPort, "-j", "DNAT", "--to-destination", dst)
-	mustIptablesRaw("-t", "nat", op, "POSTROUTING", "-p", ipProto, "-s", hostIP, "-d", hostIP, "--dport", port, "-j", "MASQUERADE")
-	mustIptablesRaw("-t", "filter", op, "DOCKER", "!", "-i", bridgeName, "-o", bridgeName, "-p", "tcp", "-d", hostIP, "--dport", port, "-j", "ACCEPT")
+func egressRules(eg egressConfig) []iptablesRule {
+	ipv6 := ipFamily(eg.Cidr) == netlink.FAMILY_V6
+	rules := []iptablesRule{}
+	outIface := []string{}
+	inIface := []string{}
+	if eg.OutIface != "" {
+		outIface = []string{"-o", eg.OutIface}
+		inIface = []string{"-i", eg.OutIface}
+	}
+	if eg.NAT {
+		target := []string{"-j", "MASQUERADE"}
+		if eg.NATSource != "" {
+			target = []string{"-j", "SNAT", "--to-source", eg.NATSource}
+		}
+		rules = append(rules, iptablesRule{ipv6: ipv6, table: "nat", chain: dovesnapNatChain, args: concatArgs([]string{"-s", eg.Cidr}, outIface, target)})
+	}
+	rules = append(rules, iptablesRule{ipv6: ipv6, table: "filter", chain: dovesnapFwdChain, args: concatArgs([]string{"-i", eg.BridgeName}, outIface, []string{"-j", "ACCEPT"})})
+	inbound := []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"}
+	if !eg.NAT {
+		// Routed networks accept new connections from outside.
+		inbound = []string{}
+	}
+	rules = append(rules, iptablesRule{ipv6: ipv6, table: "filter", chain: dovesnapFwdChain, args: concatArgs(inIface, []string{"-o", eg.BridgeName}, inbound, []string{"-j", "ACCEPT"})})
+	return rules
 }
 
-func mustAddGatewayPortMap(bridgeName string, ipProto string, gatewayIP string, hostIP string, hostPort string, port string) {
-	mustPortMap("-A", bridgeName, ipProto, gatewayIP, hostIP, hostPort, port)
+func concatArgs(args ...[]string) []string {
+	all := []string{}
+	for _, arg := range args {
+		all = append(all, arg...)
+	}
+	return all
+}
+
+func portMapRules(bridgeName string, pm PortMap) []iptablesRule {
+	ipv6 := pm.ipv6()
+	dst := net.JoinHostPort(pm.ContainerIP, pm.Port)
+	return []iptablesRule{
+		{ipv6: ipv6, table: "nat", chain: dovesnapDnatChain, args: []string{"-p", pm.Proto, "-d", pm.destIP(), "--dport", pm.HostPort, "-j", "DNAT", "--to-destination", dst}},
+		{ipv6: ipv6, table: "nat", chain: dovesnapNatChain, args: []string{"-p", pm.Proto, "-s", pm.ContainerIP, "-d", pm.ContainerIP, "--dport", pm.Port, "-j", "MASQUERADE"}},
+		{ipv6: ipv6, table: "filter", chain: dovesnapFwdChain, args: []string{"!", "-i", bridgeName, "-o", bridgeName, "-p", pm.Proto, "-d", pm.ContainerIP, "--dport", pm.Port, "-j", "ACCEPT"}},
+	}
 }
 
-func mustDeleteGatewayPortMap(bridgeName string, ipProto string, gatewayIP string, hostIP string, hostPort string, port string) {
-	mustPortMap("-D", bridgeName, ipProto, gatewayIP, hostIP, hostPort, port)
+func addIptablesRules(rules []iptablesRule) error {
+	for _, rule := range rules {
+		if err := rule.run("-A"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteIptablesRules(rules []iptablesRule) error {
+	for _, rule := range rules {
+		if err := rule.run("-D"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownRules returns the rules in this firewall's chains, for the IP versions it has chains for.
+func (f *iptablesFirewall) ownRules(rules []iptablesRule) []iptablesRule {
+	own := []iptablesRule{}
+	for _, rule := range rules {
+		if rule.ipv6 && !f.ipv6 {
+			continue
+		}
+		for _, chain := range f.chains {
+			if rule.table == chain.table && rule.chain == chain.chain {
+				own = append(own, rule)
+				break
+			}
+		}
+	}
+	return own
+}
+
+func (f *iptablesFirewall) egress(eg egressConfig, add bool) error {
+	if add {
+		return addIptablesRules(f.ownRules(egressRules(eg)))
+	}
+	return deleteIptablesRules(f.ownRules(egressRules(eg)))
+}
+
+func (f *iptablesFirewall) mustAddPortMap(bridgeName string, pm PortMap) {
+	if err := addIptablesRules(f.ownRules(portMapRules(bridgeName, pm))); err != nil {
+		panic(err)
+	}
+}
+
+func (f *iptablesFirewall) mustDeletePortMap(bridgeName string, pm PortMap) {
+	if err := deleteIptablesRules(f.ownRules(portMapRules(bridgeName, pm))); err != nil {
+		panic(err)
+	}
+}
+
+// iptablesRuleSpec returns a canonical form of a rule's arguments, to compare them with iptables -S output (which adds
+// matches for protocols and prefix lengths to addresses, and may reorder the arguments).
+func iptablesRuleSpec(args []string) string {
+	specs := []string{}
+	for i := 0; i < len(args); i++ {
+		negate := ""
+		if args[i] == "!" && i+1 < len(args) {
+			negate = "! "
+			i++
+		}
+		option := args[i]
+		value := ""
+		if i+1 < len(args) && args[i+1] != "!" && !strings.HasPrefix(args[i+1], "-") {
+			value = args[i+1]
+			i++
+		}
+		switch option {
+		case "-m":
+			continue
+		case "-s", "-d":
+			if !strings.Contains(value, "/") {
+				if ip := net.ParseIP(value); ip != nil {
+					bits := 128
+					if ip.To4() != nil {
+						bits = 32
+					}
+					value = fmt.Sprintf("%s/%d", value, bits)
+				}
+			}
+			if _, ipNet, err := net.ParseCIDR(value); err == nil {
+				value = ipNet.String()
+			}
+		}
+		specs = append(specs, negate+option+" "+value)
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, " ")
+}
+
+// iptablesTableRules returns the chains in a table, and the specs of the rules in each chain, from iptables -S.
+func iptablesTableRules(output string) (map[string]bool, map[string][]string) {
+	chains := make(map[string]bool)
+	rules := make(map[string][]string)
+	for _, line := range strings.Split(output, "\n") {
+		args := strings.Fields(line)
+		if len(args) < 2 {
+			continue
+		}
+		switch args[0] {
+		case "-P", "-N":
+			chains[args[1]] = true
+		case "-A":
+			rules[args[1]] = append(rules[args[1]], iptablesRuleSpec(args[2:]))
+		}
+	}
+	return chains, rules
+}
+
+// drifted returns true if dovesnap's chains or jumps are missing, or its chains do not have exactly the expected rules.
+// Each table is listed once, rather than checking each rule.
+func (f *iptablesFirewall) drifted(ipv6 bool, expected []iptablesRule) bool {
+	tableChains := make(map[string]map[string]bool)
+	tableRules := make(map[string]map[string][]string)
+	for _, rule := range append(append([]iptablesRule{}, f.chains...), f.jumps...) {
+		if _, ok := tableRules[rule.table]; ok {
+			continue
+		}
+		output, err := iptablesRaw(ipv6, "-t", rule.table, "-S")
+		if err != nil {
+			return true
+		}
+		tableChains[rule.table], tableRules[rule.table] = iptablesTableRules(output)
+	}
+	for _, jump := range f.jumps {
+		if !slices.Contains(tableRules[jump.table][jump.chain], iptablesRuleSpec(jump.args)) {
+			return true
+		}
+	}
+	for _, chain := range f.chains {
+		if !tableChains[chain.table][chain.chain] {
+			return true
+		}
+		want := []string{}
+		for _, rule := range expected {
+			if rule.ipv6 == ipv6 && rule.table == chain.table && rule.chain == chain.chain {
+				want = append(want, iptablesRuleSpec(rule.args))
+			}
+		}
+		got := slices.Clone(tableRules[chain.table][chain.chain])
+		sort.Strings(want)
+		sort.Strings(got)
+		if !slices.Equal(want, got) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *iptablesFirewall) reconcile(state firewallState, force bool) (bool, error) {
+	expected := []iptablesRule{}
+	for _, eg := range state.egresses {
+		expected = append(expected, egressRules(eg)...)
+	}
+	for bridgeName, portMaps := range state.portMaps {
+		for _, pm := range portMaps {
+			expected = append(expected, portMapRules(bridgeName, pm)...)
+		}
+	}
+	expected = f.ownRules(expected)
+	families := []bool{false}
+	if f.ipv6 {
+		families = append(families, true)
+	}
+	repaired := false
+	for _, ipv6 := range families {
+		if !force && !f.drifted(ipv6, expected) {
+			continue
+		}
+		if err := f.ensureChains(ipv6); err != nil {
+			return repaired, err
+		}
+		for _, chain := range f.chains {
+			if output, err := iptablesRaw(ipv6, "-t", chain.table, "-F", chain.chain); err != nil {
+				return repaired, fmt.Errorf("cannot flush %s chain %s: %s %v", chain.table, chain.chain, output, err)
+			}
+		}
+		for _, rule := range expected {
+			if rule.ipv6 != ipv6 {
+				continue
+			}
+			if err := rule.run("-A"); err != nil {
+				return repaired, err
+			}
+		}
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// ipProtoNames are the protocols docker can publish ports for, by IP protocol number.
+var ipProtoNames = map[int]string{
+	6:   "tcp",
+	17:  "udp",
+	132: "sctp",
+}
+
+func ipProtoNumber(ipProtoName string) byte {
+	for ipProto, name := range ipProtoNames {
+		if name == ipProtoName {
+			return byte(ipProto)
+		}
+	}
+	panic(fmt.Errorf("unsupported protocol %s", ipProtoName))
+}
+
+// PortMap is a docker port binding, as DNAT'd by dovesnap via the network's gateway.
+type PortMap struct {
+	Proto       string
+	HostIP      string
+	HostPort    string
+	GatewayIP   string
+	ContainerIP string
+	Port        string
+	hostPortEnd int
+}
+
+func (pm PortMap) String() string {
+	return fmt.Sprintf("%s->%s/%s", net.JoinHostPort(pm.destIP(), pm.HostPort), net.JoinHostPort(pm.ContainerIP, pm.Port), pm.Proto)
+}
+
+// destIP returns the address port mapped traffic must be sent to - the gateway, unless docker asked for a specific host IP.
+func (pm PortMap) destIP() string {
+	if pm.wildcard() {
+		return pm.GatewayIP
+	}
+	return pm.HostIP
+}
+
+func (pm PortMap) wildcard() bool {
+	hostIP := net.ParseIP(pm.HostIP)
+	return hostIP == nil || hostIP.IsUnspecified()
+}
+
+func (pm PortMap) ipv6() bool {
+	return net.ParseIP(pm.ContainerIP).To4() == nil
+}
+
+// conflicts returns true if both port maps would DNAT the same traffic.
+func (pm PortMap) conflicts(other PortMap) bool {
+	if pm.Proto != other.Proto || pm.HostPort != other.HostPort || pm.ipv6() != other.ipv6() {
+		return false
+	}
+	return pm.wildcard() || other.wildcard() || pm.destIP() == other.destIP()
+}
+
+// hostPortInUse returns true if a host process (e.g. docker-proxy for another network) is already bound to a port map's host port.
+func (pm PortMap) hostPortInUse() bool {
+	addr := net.JoinHostPort(pm.destIP(), pm.HostPort)
+	var err error
+	switch pm.Proto {
+	case "tcp":
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			l.Close()
+		}
+	case "udp":
+		var l net.PacketConn
+		if l, err = net.ListenPacket("udp", addr); err == nil {
+			l.Close()
+		}
+	case "sctp":
+		err = bindSCTP(pm.destIP(), pm.HostPort)
+	}
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// bindSCTP binds (and closes) an SCTP socket to an address, as Go has no SCTP listener.
+// Without kernel SCTP support no process can be bound, so only EADDRINUSE matters.
+func bindSCTP(ipStr string, portStr string) error {
+	ip := net.ParseIP(ipStr)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return fmt.Errorf("invalid SCTP address %s", net.JoinHostPort(ipStr, portStr))
+	}
+	family := syscall.AF_INET6
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		family = syscall.AF_INET
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.Bind(fd, sa)
+}
+
+// mustGetPortMap returns a port binding from docker, with the container address in the binding's address family.
+// Returns false if the binding is for a wildcard address in a family the container has no address in, or the
+// network has no gateway in (as wildcard bindings are DNAT'd via the gateway).
+func mustGetPortMap(portMapRaw interface{}, settings *network.EndpointSettings) (PortMap, bool) {
+	portMap := portMapRaw.(map[string]interface{})
+	port := int(portMap["Port"].(float64))
+	hostPort := int(portMap["HostPort"].(float64))
+	hostPortEnd := 0
+	if hostPortEndRaw, ok := portMap["HostPortEnd"].(float64); ok {
+		hostPortEnd = int(hostPortEndRaw)
+	}
+	if hostPort == 0 {
+		// Docker would allocate a host port using docker-proxy - we use the same port as the container.
+		hostPort = port
+		hostPortEnd = 0
+	}
+	if hostPortEnd != 0 && hostPortEnd < hostPort {
+		panic(fmt.Errorf("invalid host port range %d-%d", hostPort, hostPortEnd))
+	}
+	ipProto := int(portMap["Proto"].(float64))
+	ipProtoName, ok := ipProtoNames[ipProto]
+	if !ok {
+		panic(fmt.Errorf("unsupported port map protocol %d", ipProto))
+	}
+	hostIP, _ := portMap["HostIP"].(string)
+	containerIP := settings.IPAddress
+	gatewayIP := settings.Gateway
+	if parsedHostIP := net.ParseIP(hostIP); parsedHostIP != nil && parsedHostIP.To4() == nil {
+		containerIP = settings.GlobalIPv6Address
+		gatewayIP = settings.IPv6Gateway
+		if containerIP == "" {
+			if parsedHostIP.IsUnspecified() {
+				return PortMap{}, false
+			}
+			panic(fmt.Errorf("cannot map %s port %d from IPv6 host address %s: container has no IPv6 address", ipProtoName, port, hostIP))
+		}
+		if gatewayIP == "" && parsedHostIP.IsUnspecified() {
+			return PortMap{}, false
+		}
+	}
+	return PortMap{
+		Proto:       ipProtoName,
+		HostIP:      hostIP,
+		HostPort:    fmt.Sprintf("%d", hostPort),
+		GatewayIP:   gatewayIP,
+		ContainerIP: containerIP,
+		Port:        fmt.Sprintf("%d", port),
+		hostPortEnd: hostPortEnd,
+	}, true
+}
+
+// mustGetPortMaps returns the port bindings from a Join() or ProgramExternalConnectivity() request.
+func mustGetPortMaps(options map[string]interface{}, settings *network.EndpointSettings) []PortMap {
+	portMaps := []PortMap{}
+	portMapsRaw, ok := options[portMapOption].([]interface{})
+	if !ok {
+		return portMaps
+	}
+	for _, portMapRaw := range portMapsRaw {
+		if portMap, ok := mustGetPortMap(portMapRaw, settings); ok {
+			portMaps = append(portMaps, portMap)
+		}
+	}
+	return portMaps
+}
+
+// mustAllocatePortMap picks the first host port in a port map's range, that neither
+// conflicts with existing port maps nor is in use on the host.
+func mustAllocatePortMap(pm PortMap, inUse []PortMap) PortMap {
+	hostPort, _ := strconv.Atoi(pm.HostPort)
+	hostPortEnd := pm.hostPortEnd
+	if hostPortEnd == 0 {
+		hostPortEnd = hostPort
+	}
+	for ; hostPort <= hostPortEnd; hostPort++ {
+		candidate := pm
+		candidate.HostPort = fmt.Sprintf("%d", hostPort)
+		conflict := false
+		for _, other := range inUse {
+			if candidate.conflicts(other) {
+				conflict = true
+				break
+			}
+		}
+		if !conflict && !candidate.hostPortInUse() {
+			candidate.hostPortEnd = 0
+			return candidate
+		}
+	}
+	if pm.hostPortEnd != 0 {
+		panic(fmt.Errorf("no free host port for %s in range %s-%d", pm, pm.HostPort, pm.hostPortEnd))
+	}
+	panic(fmt.Errorf("host port for %s already in use", pm))
 }
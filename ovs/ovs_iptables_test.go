@@ -0,0 +1,49 @@
+package ovs
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestIptablesTableRules(t *testing.T) {
+	pm := PortMap{Proto: "tcp", HostIP: "0.0.0.0", HostPort: "8080", GatewayIP: "172.18.0.1", ContainerIP: "172.18.0.2", Port: "80"}
+	rules := portMapRules("odsbr0", pm)
+	// As listed by iptables -S.
+	output := `-P PREROUTING ACCEPT
+-N DOVESNAP-DNAT
+-N DOVESNAP-NAT
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOVESNAP-DNAT
+-A DOVESNAP-DNAT -d 172.18.0.1/32 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.18.0.2:80
+-A DOVESNAP-NAT -s 172.18.0.2/32 -d 172.18.0.2/32 -p tcp -m tcp --dport 80 -j MASQUERADE
+`
+	chains, tableRules := iptablesTableRules(output)
+	if !chains[dovesnapDnatChain] || !chains[dovesnapNatChain] || chains[dovesnapFwdChain] {
+		t.Errorf("iptablesTableRules() chains = %v", chains)
+	}
+	for _, rule := range rules[:2] {
+		got := tableRules[rule.chain]
+		if len(got) != 1 || got[0] != iptablesRuleSpec(rule.args) {
+			t.Errorf("%s rules = %v, want %s", rule.chain, got, iptablesRuleSpec(rule.args))
+		}
+	}
+	jump := iptablesJumps[1]
+	if got := tableRules[jump.chain]; len(got) != 1 || got[0] != iptablesRuleSpec(jump.args) {
+		t.Errorf("%s rules = %v, want %s", jump.chain, got, iptablesRuleSpec(jump.args))
+	}
+	if iptablesRuleSpec([]string{"!", "-i", "odsbr0", "-o", "odsbr0", "-j", "ACCEPT"}) == iptablesRuleSpec([]string{"-i", "odsbr0", "-o", "odsbr0", "-j", "ACCEPT"}) {
+		t.Errorf("iptablesRuleSpec() ignores negation")
+	}
+}
+
+func TestGetPortMapWildcardIPv6(t *testing.T) {
+	portMap := map[string]interface{}{"Proto": float64(6), "Port": float64(80), "HostPort": float64(8080), "HostIP": "::"}
+	settings := &network.EndpointSettings{IPAddress: "172.18.0.2", Gateway: "172.18.0.1", GlobalIPv6Address: "fd00::2"}
+	if pm, ok := mustGetPortMap(portMap, settings); ok {
+		t.Errorf("mustGetPortMap() without an IPv6 gateway = %v", pm)
+	}
+	settings.IPv6Gateway = "fd00::1"
+	if pm, ok := mustGetPortMap(portMap, settings); !ok || pm.destIP() != "fd00::1" {
+		t.Errorf("mustGetPortMap() with an IPv6 gateway = %v, %t", pm, ok)
+	}
+}
@@ -0,0 +1,180 @@
+package ovs
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// From linux/ethtool.h.
+	ethtoolSetTxCsum = 0x17
+)
+
+// netNsError is an error from an operation in a container's network namespace.
+type netNsError struct {
+	Pid    int
+	Op     string
+	IfName string
+	Err    error
+}
+
+func (e *netNsError) Error() string {
+	if e.IfName != "" {
+		return fmt.Sprintf("cannot %s %s in network namespace of pid %d: %v", e.Op, e.IfName, e.Pid, e.Err)
+	}
+	return fmt.Sprintf("cannot %s in network namespace of pid %d: %v", e.Op, e.Pid, e.Err)
+}
+
+func (e *netNsError) Unwrap() error {
+	return e.Err
+}
+
+// containerNetNs is a container's network namespace, opened from the container's PID.
+type containerNetNs struct {
+	pid    int
+	ns     netns.NsHandle
+	handle *netlink.Handle
+}
+
+// ethtoolValue and ethtoolIfreq are struct ethtool_value and struct ifreq, for SIOCETHTOOL.
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ethtoolIfreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	// The ifreq union is 24 bytes (struct ifmap), all of which the kernel copies.
+	_ [24 - unsafe.Sizeof(unsafe.Pointer(nil))]byte
+}
+
+func openContainerNetNs(pid int) (*containerNetNs, error) {
+	if pid == 0 {
+		return nil, &netNsError{Pid: pid, Op: "open", Err: fmt.Errorf("container is not running")}
+	}
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, &netNsError{Pid: pid, Op: "open", Err: err}
+	}
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		ns.Close()
+		return nil, &netNsError{Pid: pid, Op: "open netlink", Err: err}
+	}
+	return &containerNetNs{pid: pid, ns: ns, handle: handle}, nil
+}
+
+func (c *containerNetNs) Close() {
+	c.handle.Close()
+	c.ns.Close()
+}
+
+func (c *containerNetNs) error(op string, ifName string, err error) error {
+	return &netNsError{Pid: c.pid, Op: op, IfName: ifName, Err: err}
+}
+
+// do calls fn on a thread in the namespace, for operations that need more than a netlink handle (e.g. sockets,
+// which stay in the namespace they were opened in).
+func (c *containerNetNs) do(fn func() error) error {
+	runtime.LockOSThread()
+	origNs, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origNs.Close()
+	if err := netns.Set(c.ns); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	err = fn()
+	if nsErr := netns.Set(origNs); nsErr != nil {
+		// Leave the thread locked, so it exits with this goroutine rather than being reused in the wrong namespace.
+		return errors.Join(err, fmt.Errorf("cannot restore network namespace: %v", nsErr))
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+func (c *containerNetNs) linkByName(ifName string) (netlink.Link, error) {
+	link, err := c.handle.LinkByName(ifName)
+	if err != nil {
+		return nil, c.error("find", ifName, err)
+	}
+	return link, nil
+}
+
+// linkName returns the name of the interface with an index.
+func (c *containerNetNs) linkName(index int) (string, error) {
+	link, err := c.handle.LinkByIndex(index)
+	if err != nil {
+		return "", c.error("find", fmt.Sprintf("interface %d", index), err)
+	}
+	return link.Attrs().Name, nil
+}
+
+func (c *containerNetNs) setMAC(ifName string, macAddress string) error {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return c.error(fmt.Sprintf("set MAC %s on", macAddress), ifName, err)
+	}
+	link, err := c.linkByName(ifName)
+	if err != nil {
+		return err
+	}
+	if err := c.handle.LinkSetHardwareAddr(link, mac); err != nil {
+		return c.error(fmt.Sprintf("set MAC %s on", mac), ifName, err)
+	}
+	return nil
+}
+
+// addVlanSubinterface adds and brings up a VLAN subinterface (e.g. eth0.20) of an interface.
+func (c *containerNetNs) addVlanSubinterface(ifName string, vid uint) error {
+	link, err := c.linkByName(ifName)
+	if err != nil {
+		return err
+	}
+	vlanLink := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("%s.%d", ifName, vid), ParentIndex: link.Attrs().Index},
+		VlanId:    int(vid),
+	}
+	if err := c.handle.LinkAdd(vlanLink); err != nil {
+		return c.error("add VLAN subinterface", vlanLink.Name, err)
+	}
+	if err := c.handle.LinkSetUp(vlanLink); err != nil {
+		return c.error("bring up VLAN subinterface", vlanLink.Name, err)
+	}
+	return nil
+}
+
+// disableTxChecksum disables TX checksum offload (like ethtool -K tx off), which userspace OVS does not support.
+func (c *containerNetNs) disableTxChecksum(ifName string) error {
+	err := c.do(func() error {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+		value := ethtoolValue{cmd: ethtoolSetTxCsum, data: 0}
+		ifr := ethtoolIfreq{data: unsafe.Pointer(&value)}
+		copy(ifr.name[:unix.IFNAMSIZ-1], ifName)
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+		runtime.KeepAlive(&value)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return c.error("disable TX checksum offload on", ifName, err)
+	}
+	return nil
+}
@@ -0,0 +1,435 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftTableName      = "dovesnap"
+	nftPrerouting     = "prerouting"
+	nftOutput         = "output"
+	nftPostrouting    = "postrouting"
+	nftForward        = "forward"
+	nftEgressComment  = "egress"
+	nftPortMapComment = "portmap"
+	nftIfNameSize     = 16
+	nftIPv4AddrLen    = 4
+	nftIPv6AddrLen    = 16
+	nftIPv4SrcOffset  = 12
+	nftIPv4DstOffset  = 16
+	nftIPv6SrcOffset  = 8
+	nftIPv6DstOffset  = 24
+	nftDportOffset    = 2
+	nftDportLen       = 2
+	nftAddrRegister   = 1
+	nftProtoRegister  = 2
+	nftMatchRegister  = 1
+	dockerUserChain   = "DOCKER-USER"
+)
+
+// nftDockerFwdChains and nftDockerFwdJumps accept dovesnap's forwarded packets in docker's iptables filter table.
+var nftDockerFwdChains = []iptablesRule{{table: "filter", chain: dovesnapFwdChain}}
+var nftDockerFwdJumps = []iptablesRule{{table: "filter", chain: dockerUserChain, args: []string{"-j", dovesnapFwdChain}}}
+
+// nftablesFirewall programs egress rules and port maps with nftables, in dovesnap's own table.
+type nftablesFirewall struct {
+	table  *nftables.Table
+	chains map[string]*nftables.Chain
+	// dockerFwd accepts forwarded packets in docker's iptables(-nft) FORWARD chain (if docker uses iptables),
+	// as an accept in dovesnap's table does not stop another table's chain at the same hook dropping them.
+	dockerFwd *iptablesFirewall
+}
+
+func mustGetNftablesFirewall() *nftablesFirewall {
+	conn, err := nftables.New()
+	if err != nil {
+		panic(err)
+	}
+	acceptPolicy := nftables.ChainPolicyAccept
+	f := &nftablesFirewall{
+		table:  &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyINet},
+		chains: make(map[string]*nftables.Chain),
+	}
+	conn.AddTable(f.table)
+	for _, chain := range []*nftables.Chain{
+		{Name: nftPrerouting, Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest, Type: nftables.ChainTypeNAT},
+		{Name: nftOutput, Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest, Type: nftables.ChainTypeNAT},
+		{Name: nftPostrouting, Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource, Type: nftables.ChainTypeNAT},
+		{Name: nftForward, Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Type: nftables.ChainTypeFilter, Policy: &acceptPolicy},
+	} {
+		chain.Table = f.table
+		f.chains[chain.Name] = conn.AddChain(chain)
+	}
+	if err := conn.Flush(); err != nil {
+		panic(fmt.Errorf("cannot create nftables table %s: %v", nftTableName, err))
+	}
+	if _, err := iptablesRaw(false, "-t", "filter", "-S", dockerUserChain); err == nil {
+		f.dockerFwd, err = newIptablesFirewall(nftDockerFwdChains, nftDockerFwdJumps)
+		if err != nil {
+			panic(fmt.Errorf("cannot accept forwarding in docker's %s chain: %v", dockerUserChain, err))
+		}
+	}
+	return f
+}
+
+func nftIfName(name string) []byte {
+	ifName := make([]byte, nftIfNameSize)
+	copy(ifName, name)
+	return ifName
+}
+
+func nftIfNameMatch(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: nftMatchRegister},
+		&expr.Cmp{Op: op, Register: nftMatchRegister, Data: nftIfName(name)},
+	}
+}
+
+// nftIPMatch matches the source or destination address of a packet against a network.
+func nftIPMatch(ipNet *net.IPNet, dst bool) []expr.Any {
+	nfProto := byte(unix.NFPROTO_IPV4)
+	addr := ipNet.IP.To4()
+	offset := uint32(nftIPv4SrcOffset)
+	if dst {
+		offset = nftIPv4DstOffset
+	}
+	if addr == nil {
+		nfProto = unix.NFPROTO_IPV6
+		addr = ipNet.IP.To16()
+		offset = nftIPv6SrcOffset
+		if dst {
+			offset = nftIPv6DstOffset
+		}
+	}
+	mask := []byte(ipNet.Mask)
+	if len(mask) != len(addr) {
+		mask = mask[len(mask)-len(addr):]
+	}
+	match := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: nftMatchRegister},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: nftMatchRegister, Data: []byte{nfProto}},
+		&expr.Payload{DestRegister: nftMatchRegister, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ones != bits {
+		match = append(match, &expr.Bitwise{
+			SourceRegister: nftMatchRegister,
+			DestRegister:   nftMatchRegister,
+			Len:            uint32(len(addr)),
+			Mask:           mask,
+			Xor:            make([]byte, len(addr)),
+		})
+	}
+	return append(match, &expr.Cmp{Op: expr.CmpOpEq, Register: nftMatchRegister, Data: addr.Mask(mask)})
+}
+
+func nftHostMatch(ip string, dst bool) []expr.Any {
+	hostIP := net.ParseIP(ip)
+	if hostIP == nil {
+		panic(fmt.Errorf("invalid IP %s", ip))
+	}
+	bits := nftIPv6AddrLen * 8
+	if hostIP.To4() != nil {
+		hostIP = hostIP.To4()
+		bits = nftIPv4AddrLen * 8
+	}
+	return nftIPMatch(&net.IPNet{IP: hostIP, Mask: net.CIDRMask(bits, bits)}, dst)
+}
+
+func nftPort(port string) []byte {
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		panic(fmt.Errorf("invalid port %s: %v", port, err))
+	}
+	return binaryutil.BigEndian.PutUint16(uint16(portNum))
+}
+
+func nftDportMatch(proto string, port string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: nftMatchRegister},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: nftMatchRegister, Data: []byte{ipProtoNumber(proto)}},
+		&expr.Payload{DestRegister: nftMatchRegister, Base: expr.PayloadBaseTransportHeader, Offset: nftDportOffset, Len: nftDportLen},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: nftMatchRegister, Data: nftPort(port)},
+	}
+}
+
+func nftDNAT(ip string, port string) []expr.Any {
+	family := uint32(unix.NFPROTO_IPV6)
+	addr := net.ParseIP(ip)
+	if addr.To4() != nil {
+		family = unix.NFPROTO_IPV4
+		addr = addr.To4()
+	}
+	return []expr.Any{
+		&expr.Immediate{Register: nftAddrRegister, Data: addr},
+		&expr.Immediate{Register: nftProtoRegister, Data: nftPort(port)},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: family, RegAddrMin: nftAddrRegister, RegProtoMin: nftProtoRegister, Specified: true},
+	}
+}
+
+func nftComment(comment string) []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, comment)
+}
+
+func getNftComment(rule *nftables.Rule) string {
+	comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment)
+	return comment
+}
+
+func egressComment(eg egressConfig) string {
+	return strings.Join([]string{nftEgressComment, eg.Cidr, eg.BridgeName}, " ")
+}
+
+func portMapComment(bridgeName string, pm PortMap) string {
+	return strings.Join([]string{nftPortMapComment, bridgeName, pm.String()}, " ")
+}
+
+func concatExprs(exprs ...[]expr.Any) []expr.Any {
+	all := []expr.Any{}
+	for _, e := range exprs {
+		all = append(all, e...)
+	}
+	return all
+}
+
+// nftRuleSet is rules to add to dovesnap's table, by chain.
+type nftRuleSet map[string][][]expr.Any
+
+func (f *nftablesFirewall) queueRules(conn *nftables.Conn, comment string, rules nftRuleSet) {
+	for _, chainName := range []string{nftPrerouting, nftOutput, nftPostrouting, nftForward} {
+		for _, exprs := range rules[chainName] {
+			conn.AddRule(&nftables.Rule{
+				Table:    f.table,
+				Chain:    f.chains[chainName],
+				Exprs:    exprs,
+				UserData: nftComment(comment),
+			})
+		}
+	}
+}
+
+func (f *nftablesFirewall) addRules(comment string, rules nftRuleSet) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	f.queueRules(conn, comment, rules)
+	return conn.Flush()
+}
+
+// deleteRules deletes all rules in dovesnap's table with a comment.
+func (f *nftablesFirewall) deleteRules(comment string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	for _, chain := range f.chains {
+		rules, err := conn.GetRules(f.table, chain)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if getNftComment(rule) != comment {
+				continue
+			}
+			if err := conn.DelRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return conn.Flush()
+}
+
+func nftCtEstablishedMatch() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: nftMatchRegister, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: nftMatchRegister,
+			DestRegister:   nftMatchRegister,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: nftMatchRegister, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func nftEgressRules(eg egressConfig) (nftRuleSet, error) {
+	_, ipNet, err := net.ParseCIDR(eg.Cidr)
+	if err != nil {
+		return nil, err
+	}
+	outIface := []expr.Any{}
+	inIface := []expr.Any{}
+	if eg.OutIface != "" {
+		outIface = nftIfNameMatch(expr.MetaKeyOIFNAME, expr.CmpOpEq, eg.OutIface)
+		inIface = nftIfNameMatch(expr.MetaKeyIIFNAME, expr.CmpOpEq, eg.OutIface)
+	}
+	accept := []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+	inbound := nftCtEstablishedMatch()
+	if !eg.NAT {
+		// Routed networks accept new connections from outside.
+		inbound = []expr.Any{}
+	}
+	rules := nftRuleSet{
+		nftForward: {
+			concatExprs(nftIfNameMatch(expr.MetaKeyIIFNAME, expr.CmpOpEq, eg.BridgeName), outIface, accept),
+			concatExprs(inIface, nftIfNameMatch(expr.MetaKeyOIFNAME, expr.CmpOpEq, eg.BridgeName), inbound, accept),
+		},
+	}
+	if eg.NAT {
+		nat := []expr.Any{&expr.Masq{}}
+		if eg.NATSource != "" {
+			family := uint32(unix.NFPROTO_IPV6)
+			source := net.ParseIP(eg.NATSource)
+			if source.To4() != nil {
+				family = unix.NFPROTO_IPV4
+				source = source.To4()
+			}
+			nat = []expr.Any{
+				&expr.Immediate{Register: nftAddrRegister, Data: source},
+				&expr.NAT{Type: expr.NATTypeSourceNAT, Family: family, RegAddrMin: nftAddrRegister},
+			}
+		}
+		rules[nftPostrouting] = [][]expr.Any{concatExprs(nftIPMatch(ipNet, false), outIface, nat)}
+	}
+	return rules, nil
+}
+
+func nftPortMapRules(bridgeName string, pm PortMap) nftRuleSet {
+	dnat := concatExprs(nftHostMatch(pm.destIP(), true), nftDportMatch(pm.Proto, pm.HostPort), nftDNAT(pm.ContainerIP, pm.Port))
+	return nftRuleSet{
+		nftPrerouting: {dnat},
+		nftOutput:     {dnat},
+		nftPostrouting: {
+			concatExprs(nftHostMatch(pm.ContainerIP, false), nftHostMatch(pm.ContainerIP, true), nftDportMatch(pm.Proto, pm.Port), []expr.Any{&expr.Masq{}}),
+		},
+		nftForward: {
+			concatExprs(
+				nftIfNameMatch(expr.MetaKeyIIFNAME, expr.CmpOpNeq, bridgeName),
+				nftIfNameMatch(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+				nftHostMatch(pm.ContainerIP, true),
+				nftDportMatch(pm.Proto, pm.Port),
+				[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}),
+		},
+	}
+}
+
+func (f *nftablesFirewall) egress(eg egressConfig, add bool) error {
+	if f.dockerFwd != nil {
+		if err := f.dockerFwd.egress(eg, add); err != nil {
+			return err
+		}
+	}
+	comment := egressComment(eg)
+	if !add {
+		return f.deleteRules(comment)
+	}
+	rules, err := nftEgressRules(eg)
+	if err != nil {
+		return err
+	}
+	return f.addRules(comment, rules)
+}
+
+func (f *nftablesFirewall) mustAddPortMap(bridgeName string, pm PortMap) {
+	if f.dockerFwd != nil {
+		f.dockerFwd.mustAddPortMap(bridgeName, pm)
+	}
+	if err := f.addRules(portMapComment(bridgeName, pm), nftPortMapRules(bridgeName, pm)); err != nil {
+		panic(fmt.Errorf("cannot add nftables port map %s: %v", pm, err))
+	}
+}
+
+func (f *nftablesFirewall) mustDeletePortMap(bridgeName string, pm PortMap) {
+	if f.dockerFwd != nil {
+		f.dockerFwd.mustDeletePortMap(bridgeName, pm)
+	}
+	if err := f.deleteRules(portMapComment(bridgeName, pm)); err != nil {
+		panic(fmt.Errorf("cannot delete nftables port map %s: %v", pm, err))
+	}
+}
+
+// ruleCounts returns the number of rules with each comment, in each of dovesnap's chains.
+func (f *nftablesFirewall) ruleCounts(conn *nftables.Conn) (map[string]int, error) {
+	counts := make(map[string]int)
+	for chainName, chain := range f.chains {
+		rules, err := conn.GetRules(f.table, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			counts[chainName+" "+getNftComment(rule)]++
+		}
+	}
+	return counts, nil
+}
+
+func (f *nftablesFirewall) reconcile(state firewallState, force bool) (bool, error) {
+	repaired := false
+	if f.dockerFwd != nil {
+		var err error
+		if repaired, err = f.dockerFwd.reconcile(state, force); err != nil {
+			return repaired, err
+		}
+	}
+	tableRepaired, err := f.reconcileTable(state, force)
+	return repaired || tableRepaired, err
+}
+
+// reconcileTable replaces the rules in dovesnap's table, if they have drifted.
+func (f *nftablesFirewall) reconcileTable(state firewallState, force bool) (bool, error) {
+	expected := make(map[string]nftRuleSet)
+	for _, eg := range state.egresses {
+		rules, err := nftEgressRules(eg)
+		if err != nil {
+			return false, err
+		}
+		expected[egressComment(eg)] = rules
+	}
+	for bridgeName, portMaps := range state.portMaps {
+		for _, pm := range portMaps {
+			expected[portMapComment(bridgeName, pm)] = nftPortMapRules(bridgeName, pm)
+		}
+	}
+	expectedCounts := make(map[string]int)
+	for comment, rules := range expected {
+		for chainName, chainRules := range rules {
+			expectedCounts[chainName+" "+comment] += len(chainRules)
+		}
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return false, err
+	}
+	if !force {
+		counts, err := f.ruleCounts(conn)
+		if err == nil && reflect.DeepEqual(counts, expectedCounts) {
+			return false, nil
+		}
+	}
+	// Recreate the table if it was deleted, and replace all rules.
+	conn.AddTable(f.table)
+	for _, chain := range f.chains {
+		conn.AddChain(chain)
+	}
+	conn.FlushTable(f.table)
+	for comment, rules := range expected {
+		f.queueRules(conn, comment, rules)
+	}
+	if err := conn.Flush(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
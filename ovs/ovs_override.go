@@ -0,0 +1,307 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var containerOverridesFile = filepath.Join(dovesnapStatePath, "container-overrides.json")
+
+// ContainerOverride overrides a container's labels on a network, until cleared. Nil fields are not overridden.
+type ContainerOverride struct {
+	PortAcl    *string          `json:",omitempty"`
+	Mirror     *bool            `json:",omitempty"`
+	Quarantine *QuarantineState `json:",omitempty"`
+}
+
+// containerOverrides are keyed by network name and container ID, so they apply again if the container restarts.
+type containerOverrides map[string]ContainerOverride
+
+func containerOverrideKey(networkName string, containerID string) string {
+	return networkName + "/" + containerID
+}
+
+// mustPruneContainerOverrides removes overrides for containers that no longer exist (and so cannot restart).
+func (d *Driver) mustPruneContainerOverrides() {
+	if len(d.containerOverrides) == 0 {
+		return
+	}
+	containerIDs := d.dockerer.mustGetAllContainerIDs()
+	pruned := 0
+	for key := range d.containerOverrides {
+		if containerIDs[key[strings.LastIndex(key, "/")+1:]] {
+			continue
+		}
+		log.Infof("GC pruned container override %s", key)
+		delete(d.containerOverrides, key)
+		pruned++
+	}
+	if pruned > 0 {
+		d.containerOverrides.save()
+	}
+}
+
+func loadContainerOverrides() containerOverrides {
+	overrides := make(containerOverrides)
+	content, err := os.ReadFile(containerOverridesFile)
+	if err != nil {
+		return overrides
+	}
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		log.Warnf("cannot parse container overrides from %s: %v", containerOverridesFile, err)
+		return overrides
+	}
+	log.Infof("restored %d container overrides from %s", len(overrides), containerOverridesFile)
+	return overrides
+}
+
+func (o containerOverrides) save() {
+	content, err := json.Marshal(o)
+	if err != nil {
+		log.Warnf("cannot encode container overrides: %v", err)
+		return
+	}
+	tmpFile := containerOverridesFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		log.Warnf("cannot save container overrides to %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, containerOverridesFile); err != nil {
+		log.Warnf("cannot save container overrides to %s: %v", containerOverridesFile, err)
+	}
+}
+
+// getLabelPortAcl returns a container's port ACL from its labels (its inline ACL, then any named ACLs), or the network's default.
+func getLabelPortAcl(ns NetworkState, endpointID string, labels map[string]string) string {
+	rules, rulesOk := labels["dovesnap.faucet.portacl_rules"]
+	portAcl, ok := labels["dovesnap.faucet.portacl"]
+	if rulesOk && len(rules) > 0 {
+		acls := []string{containerInlineAclName(endpointID)}
+		if ok && len(portAcl) > 0 {
+			if networkPortAcl := getStrForNetwork(portAcl, ns.NetworkName); networkPortAcl != "" {
+				acls = append(acls, networkPortAcl)
+			}
+		}
+		return strings.Join(acls, ", ")
+	}
+	if ok && len(portAcl) > 0 {
+		return getStrForNetwork(portAcl, ns.NetworkName)
+	}
+	return getNetworkAcls(ns, inlineDefaultAcl, getStrForNetwork(ns.DefaultAcl, ns.NetworkName))
+}
+
+// mustGetLabelVLANs returns a container's native and tagged VLANs from its labels, which must exist on the network's DP.
+func mustGetLabelVLANs(d *Driver, ns NetworkState, labels map[string]string, name string) (uint, []uint) {
+	vlan := ns.BridgeVLAN
+	vlanLabel, ok := labels["dovesnap.faucet.vlan"]
+	if ok && len(getStrForNetwork(vlanLabel, ns.NetworkName)) > 0 {
+		vlan = mustParseVLAN(getStrForNetwork(vlanLabel, ns.NetworkName))
+		if vlan != ns.BridgeVLAN && !d.faucetconfrpcer.mustGetDpVlans(ns.NetworkName)[vlan] {
+			panic(fmt.Errorf("VLAN %d for %s is not defined on %s", vlan, name, ns.NetworkName))
+		}
+		log.Infof("Set VLAN %d on %s", vlan, name)
+	}
+	taggedVlans := []uint{}
+	taggedVlansLabel, ok := labels["dovesnap.faucet.tagged_vlans"]
+	if ok && len(getStrForNetwork(taggedVlansLabel, ns.NetworkName)) > 0 {
+		dpVlans := d.faucetconfrpcer.mustGetDpVlans(ns.NetworkName)
+		for _, taggedVlan := range mustParseVLANs(getStrForNetwork(taggedVlansLabel, ns.NetworkName)) {
+			if taggedVlan == vlan {
+				panic(fmt.Errorf("VLAN %d for %s cannot be both native and tagged", taggedVlan, name))
+			}
+			if taggedVlan != ns.BridgeVLAN && !dpVlans[taggedVlan] {
+				panic(fmt.Errorf("VLAN %d for %s is not defined on %s", taggedVlan, name, ns.NetworkName))
+			}
+			taggedVlans = append(taggedVlans, taggedVlan)
+		}
+		log.Infof("Set tagged VLANs %s on %s", formatVLANs(taggedVlans), name)
+	}
+	return vlan, taggedVlans
+}
+
+func getLabelMirror(ns NetworkState, labels map[string]string) bool {
+	mirror, ok := labels["dovesnap.faucet.mirror"]
+	return ok && parseBool(getStrForNetwork(mirror, ns.NetworkName))
+}
+
+// mustFindJoinedEndpoint returns the endpoint ID of a container (by name or ID prefix) on a network (any network, if not specified).
+func mustFindJoinedEndpoint(d *Driver, container string, networkName string, OFPorts *map[string]OFPortContainer) string {
+	matches := []string{}
+	for endpointID, containerMap := range *OFPorts {
+		if containerMap.state != endpointJoined {
+			continue
+		}
+		if networkName != "" && d.networks[containerMap.NetworkID].NetworkName != networkName {
+			continue
+		}
+		inspect := containerMap.containerInspect
+		if strings.TrimPrefix(inspect.Name, "/") == strings.TrimPrefix(container, "/") || strings.HasPrefix(inspect.ID, container) {
+			matches = append(matches, endpointID)
+		}
+	}
+	if len(matches) == 0 {
+		panic(fmt.Errorf("container %s not found on a dovesnap network", container))
+	}
+	if len(matches) > 1 {
+		panic(fmt.Errorf("container %s is on more than one dovesnap network, network must be specified", container))
+	}
+	return matches[0]
+}
+
+// mustApplyPortAcl changes a joined container's port ACL in FAUCET.
+func mustApplyPortAcl(d *Driver, ns NetworkState, containerState *ContainerState, portAcl string) {
+	d.faucetconfrpcer.mustSetPortAcl(ns.NetworkName, containerState.OFPort, getPortAcls(containerState.PortSecurityAcl, containerState.PolicyAcl, portAcl, containerState.RateLimits))
+	log.Infof("Set portacl %s on %s", portAcl, containerState.Name)
+	containerState.PortAcl = portAcl
+}
+
+// mustApplyMirror starts or stops mirroring a joined container.
+func mustApplyMirror(d *Driver, networkID string, containerState *ContainerState, mirror bool) {
+	if mirror == containerState.Mirror {
+		return
+	}
+	if !usingStackMirroring(d) && !usingMirrorBridge(d) {
+		panic(fmt.Errorf("mirroring is not configured"))
+	}
+	ns := d.networks[networkID]
+	lbPort := d.stackMirrorConfigs[networkID].LbPort
+	if mirror {
+		d.faucetconfrpcer.mustAddPortMirror(ns.NetworkName, containerState.OFPort, lbPort)
+		log.Infof("Mirroring container %s", containerState.Name)
+	} else {
+		d.faucetconfrpcer.mustRemovePortMirror(ns.NetworkName, containerState.OFPort, lbPort)
+		log.Infof("Stopped mirroring container %s", containerState.Name)
+	}
+	containerState.Mirror = mirror
+}
+
+// mustHandleOverride sets or clears (if the op's override field is nil) a container's port ACL or mirroring.
+func mustHandleOverride(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	reply := DovesnapOpReply{}
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleOverride failed: %v", rerr)
+			reply.Err = fmt.Errorf("%v", rerr)
+		}
+		opMsg.Reply <- reply
+	}()
+
+	endpointID := mustFindJoinedEndpoint(d, opMsg.Container, opMsg.NetworkName, OFPorts)
+	containerMap := (*OFPorts)[endpointID]
+	ns := d.networks[containerMap.NetworkID]
+	containerState := ns.DynamicNetworkStates.Containers[endpointID]
+	key := containerOverrideKey(ns.NetworkName, containerMap.containerInspect.ID)
+	override := d.containerOverrides[key]
+	if override.Quarantine != nil {
+		panic(fmt.Errorf("container %s is quarantined, and must be released first", containerState.Name))
+	}
+
+	switch opMsg.Operation {
+	case "overrideportacl":
+		portAcl := getLabelPortAcl(ns, endpointID, containerState.Labels)
+		if opMsg.Override.PortAcl != nil {
+			portAcl = *opMsg.Override.PortAcl
+		}
+		mustCheckMeteredPortAcl(containerState.RateLimits.Meter != "", portAcl)
+		mustApplyPortAcl(d, ns, &containerState, portAcl)
+		override.PortAcl = opMsg.Override.PortAcl
+	case "overridemirror":
+		mirror := getLabelMirror(ns, containerState.Labels)
+		if opMsg.Override.Mirror != nil {
+			mirror = *opMsg.Override.Mirror
+		}
+		mustApplyMirror(d, containerMap.NetworkID, &containerState, mirror)
+		override.Mirror = opMsg.Override.Mirror
+	}
+
+	if override.PortAcl == nil && override.Mirror == nil {
+		delete(d.containerOverrides, key)
+	} else {
+		d.containerOverrides[key] = override
+	}
+	d.containerOverrides.save()
+	containerState.Override = override
+	ns.DynamicNetworkStates.Containers[endpointID] = containerState
+
+	d.notifyMsgChan <- NotifyMsg{
+		Type:         "CONTAINER",
+		Operation:    "OVERRIDE",
+		NetworkState: ns,
+		Details: map[string]string{
+			"name":    containerState.Name,
+			"id":      containerState.Id,
+			"port":    fmt.Sprintf("%d", containerState.OFPort),
+			"acls_in": containerState.PortAcl,
+			"mirror":  fmt.Sprintf("%t", containerState.Mirror),
+		},
+	}
+}
+
+// webRequestHeader must be set on requests that change state. Browsers cannot set it on a cross-origin request without
+// a CORS preflight (which the status server does not answer), so a page cannot forge requests (CSRF) from an authorized IP.
+const webRequestHeader = "X-Dovesnap-Request"
+
+// checkWebPost checks a state changing request is a POST with webRequestHeader, and if not, replies with an error.
+func checkWebPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return false
+	}
+	if r.Header.Get(webRequestHeader) == "" {
+		http.Error(w, fmt.Sprintf("%s header required", webRequestHeader), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleOverrideWeb sets a container's port ACL (acls, or clear=true) or mirroring (mirror=true/false, or clear=true).
+func (d *Driver) handleOverrideWeb(w http.ResponseWriter, r *http.Request, operation string, field string) {
+	remoteIP := getRemoteIp(r)
+	if !isAuthIP(remoteIP, d.authIPs) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+	if !checkWebPost(w, r) {
+		return
+	}
+	container := r.FormValue("container")
+	if container == "" {
+		http.Error(w, "container required", http.StatusBadRequest)
+		return
+	}
+	requestMsg := DovesnapOp{
+		Operation:   operation,
+		Container:   container,
+		NetworkName: r.FormValue("network"),
+		Reply:       make(chan DovesnapOpReply, 2),
+	}
+	if !parseBool(r.FormValue("clear")) {
+		value, ok := r.Form[field]
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s or clear required", field), http.StatusBadRequest)
+			return
+		}
+		switch field {
+		case "acls":
+			requestMsg.Override.PortAcl = &value[0]
+		case "mirror":
+			mirror := parseBool(value[0])
+			requestMsg.Override.Mirror = &mirror
+		}
+	}
+	log.Infof("web request from %s to %s %s", remoteIP, operation, container)
+	d.dovesnapOpChan <- requestMsg
+	reply := <-requestMsg.Reply
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,789 @@
+package ovs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	policyAclPrefix = "dovesnap-policy-"
+	ethTypeIPv4     = 0x800
+	ethTypeIPv6     = 0x86dd
+)
+
+var apiPoliciesFile = filepath.Join(dovesnapStatePath, "policies.yaml")
+
+var policyIpProtos = map[string]uint8{
+	"TCP":  6,
+	"UDP":  17,
+	"SCTP": 132,
+}
+
+var policyIpProtoNames = map[uint8]string{
+	6:   "tcp",
+	17:  "udp",
+	132: "sctp",
+}
+
+// Traffic policies do not restrict: IPv6 neighbor discovery (router and neighbor solicitations and advertisements),
+// and DHCP (which dovesnap's own DHCP client needs).
+var policyAlwaysAllowed = []string{
+	"eth_type: 0x86dd, ip_proto: 58, icmpv6_type: 133",
+	"eth_type: 0x86dd, ip_proto: 58, icmpv6_type: 134",
+	"eth_type: 0x86dd, ip_proto: 58, icmpv6_type: 135",
+	"eth_type: 0x86dd, ip_proto: 58, icmpv6_type: 136",
+	"eth_type: 0x800, ip_proto: 17, udp_dst: 67",
+	"eth_type: 0x86dd, ip_proto: 17, udp_dst: 547",
+}
+
+// NetworkPolicy is a Kubernetes NetworkPolicy style policy, that selects containers by label (on a network,
+// or any dovesnap network if not specified), and allows traffic to (ingress) and from (egress) them.
+type NetworkPolicy struct {
+	APIVersion string `yaml:"apiVersion,omitempty"`
+	Kind       string `yaml:"kind,omitempty"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Network     string              `yaml:"network,omitempty"`
+		PodSelector policyLabelSelector `yaml:"podSelector"`
+		PolicyTypes []string            `yaml:"policyTypes,omitempty"`
+		Ingress     []policyRule        `yaml:"ingress,omitempty"`
+		Egress      []policyRule        `yaml:"egress,omitempty"`
+	} `yaml:"spec"`
+}
+
+type policyLabelSelector struct {
+	MatchLabels      map[string]string                `yaml:"matchLabels,omitempty"`
+	MatchExpressions []policyLabelSelectorRequirement `yaml:"matchExpressions,omitempty"`
+}
+
+type policyLabelSelectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values,omitempty"`
+}
+
+// policyPeer is a container on the policy's network (selected by label), or a CIDR.
+type policyPeer struct {
+	PodSelector *policyLabelSelector `yaml:"podSelector,omitempty"`
+	IPBlock     *struct {
+		CIDR string `yaml:"cidr"`
+	} `yaml:"ipBlock,omitempty"`
+}
+
+type policyPort struct {
+	Protocol string `yaml:"protocol,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+}
+
+// policyRule allows traffic from (ingress) or to (egress) peers (or all, if none), on ports (or all, if none).
+type policyRule struct {
+	From  []policyPeer `yaml:"from,omitempty"`
+	To    []policyPeer `yaml:"to,omitempty"`
+	Ports []policyPort `yaml:"ports,omitempty"`
+}
+
+// policyPortSpec is a protocol (or 0 for any IP traffic) and destination port (or 0 for any).
+type policyPortSpec struct {
+	proto uint8
+	port  int
+}
+
+func (s policyLabelSelector) validate() error {
+	for _, req := range s.MatchExpressions {
+		switch req.Operator {
+		case "In", "NotIn":
+			if len(req.Values) == 0 {
+				return fmt.Errorf("operator %s on %s requires values", req.Operator, req.Key)
+			}
+		case "Exists", "DoesNotExist":
+		default:
+			return fmt.Errorf("invalid operator %s on %s", req.Operator, req.Key)
+		}
+	}
+	return nil
+}
+
+func (s policyLabelSelector) matches(labels map[string]string) bool {
+	for key, value := range s.MatchLabels {
+		if labelValue, ok := labels[key]; !ok || labelValue != value {
+			return false
+		}
+	}
+	for _, req := range s.MatchExpressions {
+		value, ok := labels[req.Key]
+		switch req.Operator {
+		case "In":
+			if !ok || !slices.Contains(req.Values, value) {
+				return false
+			}
+		case "NotIn":
+			if ok && slices.Contains(req.Values, value) {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p policyPeer) validate() error {
+	if (p.PodSelector == nil) == (p.IPBlock == nil) {
+		return fmt.Errorf("peer must have one of podSelector or ipBlock")
+	}
+	if p.PodSelector != nil {
+		return p.PodSelector.validate()
+	}
+	if _, _, err := net.ParseCIDR(p.IPBlock.CIDR); err != nil {
+		return err
+	}
+	return nil
+}
+
+// matches returns true if the peer is the container.
+func (p policyPeer) matches(containerState ContainerState) bool {
+	if p.PodSelector != nil {
+		return p.PodSelector.matches(containerState.Labels)
+	}
+	_, ipNet, _ := net.ParseCIDR(p.IPBlock.CIDR)
+	for _, ip := range getContainerIPs(containerState) {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r policyRule) validate() error {
+	for _, peer := range slices.Concat(r.From, r.To) {
+		if err := peer.validate(); err != nil {
+			return err
+		}
+	}
+	for _, port := range r.Ports {
+		if _, ok := policyIpProtos[strings.ToUpper(port.Protocol)]; !ok && port.Protocol != "" {
+			return fmt.Errorf("invalid protocol %s (must be TCP, UDP or SCTP)", port.Protocol)
+		}
+		if port.Port < 0 || port.Port > 65535 {
+			return fmt.Errorf("invalid port %d", port.Port)
+		}
+	}
+	return nil
+}
+
+// portSpecs returns the protocols and ports the rule allows (protocol defaults to TCP, as in Kubernetes).
+func (r policyRule) portSpecs() []policyPortSpec {
+	if len(r.Ports) == 0 {
+		return []policyPortSpec{{}}
+	}
+	specs := []policyPortSpec{}
+	for _, port := range r.Ports {
+		protocol := strings.ToUpper(port.Protocol)
+		if protocol == "" {
+			protocol = "TCP"
+		}
+		specs = append(specs, policyPortSpec{proto: policyIpProtos[protocol], port: port.Port})
+	}
+	return specs
+}
+
+func (p NetworkPolicy) validate() error {
+	if p.Metadata.Name == "" {
+		return fmt.Errorf("policy must have a name")
+	}
+	if err := p.Spec.PodSelector.validate(); err != nil {
+		return fmt.Errorf("policy %s: %v", p.Metadata.Name, err)
+	}
+	for _, policyType := range p.Spec.PolicyTypes {
+		if policyType != "Ingress" && policyType != "Egress" {
+			return fmt.Errorf("policy %s: invalid policy type %s (must be Ingress or Egress)", p.Metadata.Name, policyType)
+		}
+	}
+	for _, rule := range slices.Concat(p.Spec.Ingress, p.Spec.Egress) {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("policy %s: %v", p.Metadata.Name, err)
+		}
+	}
+	return nil
+}
+
+// hasType returns true if the policy restricts ingress or egress. As in Kubernetes, policies restrict ingress
+// (and egress, if they have egress rules) unless policyTypes are given.
+func (p NetworkPolicy) hasType(policyType string) bool {
+	if len(p.Spec.PolicyTypes) == 0 {
+		return policyType == "Ingress" || len(p.Spec.Egress) > 0
+	}
+	return slices.Contains(p.Spec.PolicyTypes, policyType)
+}
+
+func (p NetworkPolicy) rules(policyType string) []policyRule {
+	if policyType == "Ingress" {
+		return p.Spec.Ingress
+	}
+	return p.Spec.Egress
+}
+
+func (r policyRule) peers(policyType string) []policyPeer {
+	if policyType == "Ingress" {
+		return r.From
+	}
+	return r.To
+}
+
+// parsePolicies parses one or more YAML policy documents.
+func parsePolicies(content []byte) ([]NetworkPolicy, error) {
+	policies := []NetworkPolicy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	for {
+		var policy NetworkPolicy
+		err := decoder.Decode(&policy)
+		if errors.Is(err, io.EOF) {
+			return policies, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := policy.validate(); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+}
+
+func addPolicies(policies map[string]NetworkPolicy, newPolicies []NetworkPolicy, source string) error {
+	for _, policy := range newPolicies {
+		if _, ok := policies[policy.Metadata.Name]; ok {
+			return fmt.Errorf("duplicate policy %s in %s", policy.Metadata.Name, source)
+		}
+		policies[policy.Metadata.Name] = policy
+	}
+	return nil
+}
+
+func getPolicyDirFiles(policyDir string) []string {
+	files := []string{}
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(policyDir, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// getPolicyDirStamp returns the names, sizes and modification times of the policy files, to detect changes.
+func getPolicyDirStamp(policyDir string) string {
+	stamp := []string{}
+	for _, file := range getPolicyDirFiles(policyDir) {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		stamp = append(stamp, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(stamp, ",")
+}
+
+func readPolicyDir(policyDir string) (map[string]NetworkPolicy, error) {
+	policies := make(map[string]NetworkPolicy)
+	for _, file := range getPolicyDirFiles(policyDir) {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		filePolicies, err := parsePolicies(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if err := addPolicies(policies, filePolicies, file); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+func loadApiPolicies() map[string]NetworkPolicy {
+	policies := make(map[string]NetworkPolicy)
+	content, err := os.ReadFile(apiPoliciesFile)
+	if err != nil {
+		return policies
+	}
+	apiPolicies, err := parsePolicies(content)
+	if err == nil {
+		err = addPolicies(policies, apiPolicies, apiPoliciesFile)
+	}
+	if err != nil {
+		log.Warnf("cannot parse policies from %s: %v", apiPoliciesFile, err)
+		return make(map[string]NetworkPolicy)
+	}
+	log.Infof("restored %d policies from %s", len(policies), apiPoliciesFile)
+	return policies
+}
+
+func encodePolicies(policies []NetworkPolicy) ([]byte, error) {
+	var content bytes.Buffer
+	encoder := yaml.NewEncoder(&content)
+	for _, policy := range policies {
+		if err := encoder.Encode(policy); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return content.Bytes(), nil
+}
+
+func sortedPolicies(policies map[string]NetworkPolicy) []NetworkPolicy {
+	sorted := []NetworkPolicy{}
+	for _, policy := range policies {
+		sorted = append(sorted, policy)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Metadata.Name < sorted[j].Metadata.Name })
+	return sorted
+}
+
+func saveApiPolicies(policies map[string]NetworkPolicy) {
+	content, err := encodePolicies(sortedPolicies(policies))
+	if err != nil {
+		log.Warnf("cannot encode policies: %v", err)
+		return
+	}
+	tmpFile := apiPoliciesFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		log.Warnf("cannot save policies to %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, apiPoliciesFile); err != nil {
+		log.Warnf("cannot save policies to %s: %v", apiPoliciesFile, err)
+	}
+}
+
+// getNetworkPolicies returns the policies (from the policy directory and the API) for a network.
+func (d *Driver) getNetworkPolicies(ns NetworkState) []NetworkPolicy {
+	policies := []NetworkPolicy{}
+	for _, policy := range sortedPolicies(d.dirPolicies) {
+		if policy.Spec.Network == "" || policy.Spec.Network == ns.NetworkName {
+			policies = append(policies, policy)
+		}
+	}
+	for _, policy := range sortedPolicies(d.apiPolicies) {
+		if policy.Spec.Network == "" || policy.Spec.Network == ns.NetworkName {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// getContainerIPs returns a container's IPv4 and IPv6 addresses (including any DHCP address, from dovesnap's DHCP
+// client or server).
+func getContainerIPs(containerState ContainerState) []net.IP {
+	ips := []net.IP{}
+	for _, ipStr := range []string{containerState.HostIP, containerState.HostIPv6, containerState.DHCPClient.IP, containerState.DHCPServerIP} {
+		if ip := net.ParseIP(strings.Split(ipStr, "/")[0]); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// getPolicyAllowed returns whether any policy restricts traffic (of a type) to or from a container, and if so,
+// the protocols and ports allowed to or from a peer (nil for a CIDR peer).
+func getPolicyAllowed(policies []NetworkPolicy, policyType string, containerState ContainerState, peer *ContainerState) (bool, []policyPortSpec) {
+	restricted := false
+	specs := []policyPortSpec{}
+	for _, policy := range policies {
+		if !policy.hasType(policyType) || !policy.Spec.PodSelector.matches(containerState.Labels) {
+			continue
+		}
+		restricted = true
+		if peer == nil {
+			continue
+		}
+		for _, rule := range policy.rules(policyType) {
+			peers := rule.peers(policyType)
+			if len(peers) == 0 || slices.ContainsFunc(peers, func(p policyPeer) bool { return p.matches(*peer) }) {
+				specs = append(specs, rule.portSpecs()...)
+			}
+		}
+	}
+	return restricted, specs
+}
+
+// getPeerAllowed returns whether policies restrict traffic from a container to a peer container, and if so, the
+// protocols and ports that both the container's egress policies and the peer's ingress policies allow.
+func getPeerAllowed(policies []NetworkPolicy, containerState ContainerState, peerState ContainerState) (bool, []policyPortSpec) {
+	egressRestricted, egressSpecs := getPolicyAllowed(policies, "Egress", containerState, &peerState)
+	ingressRestricted, ingressSpecs := getPolicyAllowed(policies, "Ingress", peerState, &containerState)
+	switch {
+	case egressRestricted && ingressRestricted:
+		return true, intersectPortSpecs(egressSpecs, ingressSpecs)
+	case egressRestricted:
+		return true, egressSpecs
+	case ingressRestricted:
+		return true, ingressSpecs
+	}
+	return false, nil
+}
+
+// intersectPortSpecs returns the traffic both sets of protocols and ports allow.
+func intersectPortSpecs(a []policyPortSpec, b []policyPortSpec) []policyPortSpec {
+	specs := []policyPortSpec{}
+	for _, specA := range a {
+		for _, specB := range b {
+			spec := specA
+			switch {
+			case specA.proto == 0:
+				spec = specB
+			case specB.proto == 0:
+			case specA.proto != specB.proto:
+				continue
+			case specA.port == 0:
+				spec = specB
+			case specB.port != 0 && specA.port != specB.port:
+				continue
+			}
+			if !slices.Contains(specs, spec) {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	return specs
+}
+
+func policyAclRule(match string, allow bool) string {
+	allowInt := 0
+	if allow {
+		allowInt = 1
+	}
+	return fmt.Sprintf("{rule: {%s, actions: {allow: %d}}}", match, allowInt)
+}
+
+// meterPolicyAclRules adds a meter to policy ACL rules that allow traffic, which would otherwise not reach the port's meter.
+func meterPolicyAclRules(rules []string, meter string) []string {
+	metered := []string{}
+	for _, rule := range rules {
+		metered = append(metered, strings.Replace(rule, "actions: {allow: 1}", fmt.Sprintf("actions: {meter: %s, allow: 1}", meter), 1))
+	}
+	return metered
+}
+
+// policySpecMatches returns FAUCET ACL matches for a protocol and destination (or, for replies, source) port, for
+// IPv4 and IPv6 (or only ethType, if not 0).
+func policySpecMatches(prefix string, spec policyPortSpec, ethType int, reply bool) []string {
+	portField := "dst"
+	if reply {
+		portField = "src"
+	}
+	matches := []string{}
+	for _, specEthType := range []int{ethTypeIPv4, ethTypeIPv6} {
+		if ethType != 0 && ethType != specEthType {
+			continue
+		}
+		match := fmt.Sprintf("%seth_type: 0x%x", prefix, specEthType)
+		if spec.proto != 0 {
+			match += fmt.Sprintf(", ip_proto: %d", spec.proto)
+		}
+		if spec.port != 0 {
+			match += fmt.Sprintf(", %s_%s: %d", policyIpProtoNames[spec.proto], portField, spec.port)
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+func policyAclName(endpointID string) string {
+	return policyAclPrefix + vethPair(truncateID(endpointID)).Name
+}
+
+// getPolicyAclRules compiles the rules of a container's policy ACL, applied to traffic from the container: traffic to
+// other containers on the network must be allowed by both the container's egress policies and their ingress policies,
+// and other traffic by the container's egress policies. Other traffic is left to the container's other ACLs.
+func getPolicyAclRules(policies []NetworkPolicy, ns NetworkState, endpointID string) []string {
+	containerState := ns.DynamicNetworkStates.Containers[endpointID]
+	rules := []string{}
+	peerIDs := []string{}
+	for peerID := range ns.DynamicNetworkStates.Containers {
+		peerIDs = append(peerIDs, peerID)
+	}
+	sort.Strings(peerIDs)
+	for _, peerID := range peerIDs {
+		peerState := ns.DynamicNetworkStates.Containers[peerID]
+		if peerID == endpointID || peerState.MacAddress == "" {
+			continue
+		}
+		restricted, specs := getPeerAllowed(policies, containerState, peerState)
+		if !restricted {
+			continue
+		}
+		// ACLs are stateless, so replies to connections the peer may make must be allowed too.
+		_, replySpecs := getPeerAllowed(policies, peerState, containerState)
+		prefix := fmt.Sprintf("eth_dst: \"%s\", ", peerState.MacAddress)
+		for _, spec := range specs {
+			for _, match := range policySpecMatches(prefix, spec, 0, false) {
+				rules = append(rules, policyAclRule(match, true))
+			}
+		}
+		for _, spec := range replySpecs {
+			for _, match := range policySpecMatches(prefix, spec, 0, true) {
+				rules = append(rules, policyAclRule(match, true))
+			}
+		}
+		for _, match := range policySpecMatches(prefix, policyPortSpec{}, 0, false) {
+			rules = append(rules, policyAclRule(match, false))
+		}
+	}
+	if egressRestricted, _ := getPolicyAllowed(policies, "Egress", containerState, nil); egressRestricted {
+		for _, policy := range policies {
+			if !policy.hasType("Egress") || !policy.Spec.PodSelector.matches(containerState.Labels) {
+				continue
+			}
+			for _, rule := range policy.Spec.Egress {
+				for _, spec := range rule.portSpecs() {
+					if len(rule.To) == 0 {
+						for _, match := range policySpecMatches("", spec, 0, false) {
+							rules = append(rules, policyAclRule(match, true))
+						}
+					}
+					for _, peer := range rule.To {
+						if peer.IPBlock == nil {
+							continue
+						}
+						ethType, ipField := ethTypeIPv4, "ipv4_dst"
+						if strings.Contains(peer.IPBlock.CIDR, ":") {
+							ethType, ipField = ethTypeIPv6, "ipv6_dst"
+						}
+						prefix := fmt.Sprintf("%s: \"%s\", ", ipField, peer.IPBlock.CIDR)
+						for _, match := range policySpecMatches(prefix, spec, ethType, false) {
+							rules = append(rules, policyAclRule(match, true))
+						}
+					}
+				}
+			}
+		}
+		for _, match := range policySpecMatches("", policyPortSpec{}, 0, false) {
+			rules = append(rules, policyAclRule(match, false))
+		}
+	}
+	if len(rules) == 0 {
+		return rules
+	}
+	alwaysAllowedRules := []string{}
+	for _, match := range policyAlwaysAllowed {
+		alwaysAllowedRules = append(alwaysAllowedRules, policyAclRule(match, true))
+	}
+	return append(alwaysAllowedRules, rules...)
+}
+
+// compilePolicies compiles the policies for each container on a network to FAUCET ACLs, and applies any that
+// changed. Quarantined containers have no policy ACL.
+func compilePolicies(d *Driver, networkID string) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("compilePolicies failed: %v", rerr)
+		}
+	}()
+
+	ns, ok := d.networks[networkID]
+	if !ok {
+		return
+	}
+	policies := d.getNetworkPolicies(ns)
+	changedAcls := []string{}
+	changedPorts := make(map[string]string)
+	for endpointID, containerState := range ns.DynamicNetworkStates.Containers {
+		rules := []string{}
+		if containerState.Override.Quarantine == nil {
+			rules = getPolicyAclRules(policies, ns, endpointID)
+		}
+		if containerState.RateLimits.Meter != "" {
+			rules = meterPolicyAclRules(rules, containerState.RateLimits.Meter)
+		}
+		aclName := ""
+		if len(rules) > 0 {
+			aclName = policyAclName(endpointID)
+			aclYaml := fmt.Sprintf("%s: [%s]", aclName, strings.Join(rules, ", "))
+			if d.faucetAcls[aclName] != aclYaml {
+				changedAcls = append(changedAcls, aclYaml)
+				d.faucetAcls[aclName] = aclYaml
+			}
+		}
+		if aclName != containerState.PolicyAcl {
+			changedPorts[endpointID] = aclName
+		}
+	}
+	if len(changedAcls) > 0 {
+		d.faucetconfrpcer.mustSetFaucetConfigFile(fmt.Sprintf("{acls: {%s}}", strings.Join(changedAcls, ", ")))
+	}
+	for endpointID, aclName := range changedPorts {
+		containerState := ns.DynamicNetworkStates.Containers[endpointID]
+		oldAcl := containerState.PolicyAcl
+		containerState.PolicyAcl = aclName
+		d.faucetconfrpcer.mustSetPortAcl(ns.NetworkName, containerState.OFPort, getPortAcls(containerState.PortSecurityAcl, containerState.PolicyAcl, containerState.PortAcl, containerState.RateLimits))
+		ns.DynamicNetworkStates.Containers[endpointID] = containerState
+		log.Infof("Set policy ACL %s on %s", containerState.PolicyAcl, containerState.Name)
+		if oldAcl != "" && containerState.PolicyAcl == "" {
+			d.deleteFaucetAcl(oldAcl)
+		}
+	}
+}
+
+func compileAllPolicies(d *Driver) {
+	for networkID := range d.networks {
+		compilePolicies(d, networkID)
+	}
+}
+
+// deleteFaucetAcl removes a container's policy or port security ACL from FAUCET, once no port uses it.
+func (d *Driver) deleteFaucetAcl(aclName string) {
+	delete(d.faucetAcls, aclName)
+	delete(d.portSecurityRules, aclName)
+	if err := d.faucetconfrpcer.deleteConfigKeys(fmt.Sprintf("[acls, %s]", aclName)); err != nil {
+		log.Warnf("cannot delete FAUCET acls %s: %v", aclName, err)
+	}
+}
+
+// reloadPolicyDir reloads the policy directory's policies if it has changed, and recompiles them.
+func reloadPolicyDir(d *Driver) {
+	if d.policyDir == "" {
+		return
+	}
+	stamp := getPolicyDirStamp(d.policyDir)
+	if stamp == d.policyDirStamp {
+		return
+	}
+	d.policyDirStamp = stamp
+	policies, err := readPolicyDir(d.policyDir)
+	if err == nil {
+		for name := range policies {
+			if _, ok := d.apiPolicies[name]; ok {
+				err = fmt.Errorf("policy %s is also defined by the API", name)
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("cannot load policies from %s, keeping previous policies: %v", d.policyDir, err)
+		return
+	}
+	log.Infof("loaded %d policies from %s", len(policies), d.policyDir)
+	d.dirPolicies = policies
+	compileAllPolicies(d)
+}
+
+// mustHandlePolicies adds or replaces (setpolicies), deletes (deletepolicy) or returns (policies) policies.
+func mustHandlePolicies(d *Driver, opMsg DovesnapOp) {
+	reply := DovesnapOpReply{}
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandlePolicies failed: %v", rerr)
+			reply.Err = fmt.Errorf("%v", rerr)
+		}
+		opMsg.Reply <- reply
+	}()
+
+	switch opMsg.Operation {
+	case "setpolicies":
+		for _, policy := range opMsg.Policies {
+			if _, ok := d.dirPolicies[policy.Metadata.Name]; ok {
+				panic(fmt.Errorf("policy %s is defined in %s", policy.Metadata.Name, d.policyDir))
+			}
+		}
+		for _, policy := range opMsg.Policies {
+			d.apiPolicies[policy.Metadata.Name] = policy
+			log.Infof("set policy %s", policy.Metadata.Name)
+		}
+	case "deletepolicy":
+		if _, ok := d.apiPolicies[opMsg.PolicyName]; !ok {
+			panic(fmt.Errorf("policy %s not found (or not defined by the API)", opMsg.PolicyName))
+		}
+		delete(d.apiPolicies, opMsg.PolicyName)
+		log.Infof("deleted policy %s", opMsg.PolicyName)
+	case "policies":
+		policies := sortedPolicies(d.dirPolicies)
+		policies = append(policies, sortedPolicies(d.apiPolicies)...)
+		content, err := encodePolicies(policies)
+		if err != nil {
+			panic(err)
+		}
+		reply.NetworkStateString = string(content)
+		return
+	}
+	saveApiPolicies(d.apiPolicies)
+	compileAllPolicies(d)
+}
+
+// handlePoliciesWeb returns (GET), adds or replaces (POST, with YAML policies) or deletes (DELETE, with name) policies.
+func (d *Driver) handlePoliciesWeb(w http.ResponseWriter, r *http.Request) {
+	remoteIP := getRemoteIp(r)
+	if !isAuthIP(remoteIP, d.authIPs) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Header.Get(webRequestHeader) == "" {
+		http.Error(w, fmt.Sprintf("%s header required", webRequestHeader), http.StatusForbidden)
+		return
+	}
+	requestMsg := DovesnapOp{
+		Reply: make(chan DovesnapOpReply, 2),
+	}
+	switch r.Method {
+	case http.MethodGet:
+		requestMsg.Operation = "policies"
+	case http.MethodPost:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		policies, err := parsePolicies(content)
+		if err == nil {
+			err = addPolicies(make(map[string]NetworkPolicy), policies, "request")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestMsg.Operation = "setpolicies"
+		requestMsg.Policies = policies
+	case http.MethodDelete:
+		requestMsg.Operation = "deletepolicy"
+		requestMsg.PolicyName = r.FormValue("name")
+	default:
+		http.Error(w, "GET, POST or DELETE required", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infof("web request from %s to %s", remoteIP, requestMsg.Operation)
+	d.dovesnapOpChan <- requestMsg
+	reply := <-requestMsg.Reply
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestMsg.Operation == "policies" {
+		fmt.Fprint(w, reply.NetworkStateString)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,227 @@
+package ovs
+
+import (
+	"slices"
+	"testing"
+)
+
+// readmePolicy is the example policy in README.md.
+const readmePolicy = `
+metadata:
+  name: db
+spec:
+  network: mynet
+  podSelector:
+    matchLabels:
+      app: db
+  ingress:
+    - from:
+        - podSelector:
+            matchLabels:
+              app: web
+      ports:
+        - protocol: TCP
+          port: 5432
+  egress:
+    - to:
+        - ipBlock:
+            cidr: 192.168.1.0/24
+`
+
+func mustParseTestPolicies(t *testing.T, content string) []NetworkPolicy {
+	t.Helper()
+	policies, err := parsePolicies([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policies
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front"}
+	for _, tc := range []struct {
+		name     string
+		selector policyLabelSelector
+		want     bool
+	}{
+		{"empty", policyLabelSelector{}, true},
+		{"label", policyLabelSelector{MatchLabels: map[string]string{"app": "web"}}, true},
+		{"labels", policyLabelSelector{MatchLabels: map[string]string{"app": "web", "tier": "back"}}, false},
+		{"missing label", policyLabelSelector{MatchLabels: map[string]string{"env": "prod"}}, false},
+		{"in", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "app", Operator: "In", Values: []string{"db", "web"}}}}, true},
+		{"not in values", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "app", Operator: "In", Values: []string{"db"}}}}, false},
+		{"in missing", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "env", Operator: "In", Values: []string{"prod"}}}}, false},
+		{"not in", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "app", Operator: "NotIn", Values: []string{"db"}}}}, true},
+		{"not in matched", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "app", Operator: "NotIn", Values: []string{"web"}}}}, false},
+		{"not in missing", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "env", Operator: "NotIn", Values: []string{"prod"}}}}, true},
+		{"exists", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "tier", Operator: "Exists"}}}, true},
+		{"exists missing", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "env", Operator: "Exists"}}}, false},
+		{"does not exist", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "env", Operator: "DoesNotExist"}}}, true},
+		{"does not exist present", policyLabelSelector{MatchExpressions: []policyLabelSelectorRequirement{{Key: "app", Operator: "DoesNotExist"}}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.selector.matches(labels); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeerMatches(t *testing.T) {
+	containerState := ContainerState{Labels: map[string]string{"app": "web"}, HostIP: "10.0.0.2/24", DHCPClient: DHCPClientLease{IP: "192.168.1.5"}}
+	peers := mustParseTestPolicies(t, `
+metadata: {name: p}
+spec:
+  podSelector: {}
+  ingress:
+    - from:
+        - podSelector: {matchLabels: {app: web}}
+        - podSelector: {matchLabels: {app: db}}
+        - ipBlock: {cidr: 10.0.0.0/24}
+        - ipBlock: {cidr: 192.168.1.0/24}
+        - ipBlock: {cidr: 172.16.0.0/12}
+`)[0].Spec.Ingress[0].From
+	for i, want := range []bool{true, false, true, true, false} {
+		if got := peers[i].matches(containerState); got != want {
+			t.Errorf("peer %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestHasType(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		policy      string
+		wantIngress bool
+		wantEgress  bool
+	}{
+		{"default ingress", "metadata: {name: p}\nspec: {podSelector: {}}", true, false},
+		{"default with egress", "metadata: {name: p}\nspec: {podSelector: {}, egress: [{}]}", true, true},
+		{"egress only", "metadata: {name: p}\nspec: {podSelector: {}, policyTypes: [Egress]}", false, true},
+		{"both", "metadata: {name: p}\nspec: {podSelector: {}, policyTypes: [Ingress, Egress]}", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := mustParseTestPolicies(t, tc.policy)[0]
+			if got := policy.hasType("Ingress"); got != tc.wantIngress {
+				t.Errorf("Ingress: got %v, want %v", got, tc.wantIngress)
+			}
+			if got := policy.hasType("Egress"); got != tc.wantEgress {
+				t.Errorf("Egress: got %v, want %v", got, tc.wantEgress)
+			}
+		})
+	}
+}
+
+func TestIntersectPortSpecs(t *testing.T) {
+	anyIP := policyPortSpec{}
+	anyTCP := policyPortSpec{proto: 6}
+	tcp80 := policyPortSpec{proto: 6, port: 80}
+	tcp443 := policyPortSpec{proto: 6, port: 443}
+	udp53 := policyPortSpec{proto: 17, port: 53}
+	for _, tc := range []struct {
+		name string
+		a    []policyPortSpec
+		b    []policyPortSpec
+		want []policyPortSpec
+	}{
+		{"any and any", []policyPortSpec{anyIP}, []policyPortSpec{anyIP}, []policyPortSpec{anyIP}},
+		{"any and port", []policyPortSpec{anyIP}, []policyPortSpec{tcp80}, []policyPortSpec{tcp80}},
+		{"port and any", []policyPortSpec{tcp80}, []policyPortSpec{anyIP}, []policyPortSpec{tcp80}},
+		{"protocol and port", []policyPortSpec{anyTCP}, []policyPortSpec{tcp80, udp53}, []policyPortSpec{tcp80}},
+		{"port and protocol", []policyPortSpec{tcp80, udp53}, []policyPortSpec{anyTCP}, []policyPortSpec{tcp80}},
+		{"same port", []policyPortSpec{tcp80}, []policyPortSpec{tcp80}, []policyPortSpec{tcp80}},
+		{"different ports", []policyPortSpec{tcp80}, []policyPortSpec{tcp443}, []policyPortSpec{}},
+		{"different protocols", []policyPortSpec{udp53}, []policyPortSpec{anyTCP}, []policyPortSpec{}},
+		{"nothing", []policyPortSpec{}, []policyPortSpec{anyIP}, []policyPortSpec{}},
+		{"duplicates", []policyPortSpec{anyIP, anyTCP}, []policyPortSpec{tcp80}, []policyPortSpec{tcp80}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := intersectPortSpecs(tc.a, tc.b); !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetPolicyAclRulesReadmeExample(t *testing.T) {
+	policies := mustParseTestPolicies(t, readmePolicy)
+	ns := NetworkState{
+		NetworkName: "mynet",
+		DynamicNetworkStates: DynamicNetworkState{Containers: map[string]ContainerState{
+			"db":    {Name: "db", MacAddress: "0e:00:00:00:00:01", HostIP: "10.0.0.1", Labels: map[string]string{"app": "db"}},
+			"web":   {Name: "web", MacAddress: "0e:00:00:00:00:02", HostIP: "10.0.0.2", Labels: map[string]string{"app": "web"}},
+			"other": {Name: "other", MacAddress: "0e:00:00:00:00:03", HostIP: "10.0.0.3", Labels: map[string]string{"app": "other"}},
+		}},
+	}
+	alwaysAllowed := []string{}
+	for _, match := range policyAlwaysAllowed {
+		alwaysAllowed = append(alwaysAllowed, policyAclRule(match, true))
+	}
+	toDb := `eth_dst: "0e:00:00:00:00:01", `
+	toWeb := `eth_dst: "0e:00:00:00:00:02", `
+	toOther := `eth_dst: "0e:00:00:00:00:03", `
+	for _, tc := range []struct {
+		endpointID string
+		want       []string
+	}{
+		// web may connect to db's PostgreSQL port, but nothing else on db.
+		{"web", slices.Concat(alwaysAllowed, []string{
+			policyAclRule(toDb+"eth_type: 0x800, ip_proto: 6, tcp_dst: 5432", true),
+			policyAclRule(toDb+"eth_type: 0x86dd, ip_proto: 6, tcp_dst: 5432", true),
+			policyAclRule(toDb+"eth_type: 0x800", false),
+			policyAclRule(toDb+"eth_type: 0x86dd", false),
+		})},
+		// db may reply to web's connections, and send only to 192.168.1.0/24.
+		{"db", slices.Concat(alwaysAllowed, []string{
+			policyAclRule(toOther+"eth_type: 0x800", false),
+			policyAclRule(toOther+"eth_type: 0x86dd", false),
+			policyAclRule(toWeb+"eth_type: 0x800, ip_proto: 6, tcp_src: 5432", true),
+			policyAclRule(toWeb+"eth_type: 0x86dd, ip_proto: 6, tcp_src: 5432", true),
+			policyAclRule(toWeb+"eth_type: 0x800", false),
+			policyAclRule(toWeb+"eth_type: 0x86dd", false),
+			policyAclRule(`ipv4_dst: "192.168.1.0/24", eth_type: 0x800`, true),
+			policyAclRule("eth_type: 0x800", false),
+			policyAclRule("eth_type: 0x86dd", false),
+		})},
+		// other may not send anything to db.
+		{"other", slices.Concat(alwaysAllowed, []string{
+			policyAclRule(toDb+"eth_type: 0x800", false),
+			policyAclRule(toDb+"eth_type: 0x86dd", false),
+		})},
+	} {
+		t.Run(tc.endpointID, func(t *testing.T) {
+			if got := getPolicyAclRules(policies, ns, tc.endpointID); !slices.Equal(got, tc.want) {
+				t.Errorf("got\n%v\nwant\n%v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetPolicyAclRulesUnrestricted(t *testing.T) {
+	policies := mustParseTestPolicies(t, "metadata: {name: p}\nspec: {podSelector: {matchLabels: {app: db}}, ingress: [{}]}")
+	ns := NetworkState{
+		DynamicNetworkStates: DynamicNetworkState{Containers: map[string]ContainerState{
+			"db":  {MacAddress: "0e:00:00:00:00:01", Labels: map[string]string{"app": "db"}},
+			"web": {MacAddress: "0e:00:00:00:00:02", Labels: map[string]string{"app": "web"}},
+		}},
+	}
+	// db's egress is not restricted, so it needs no rules.
+	if got := getPolicyAclRules(policies, ns, "db"); len(got) != 0 {
+		t.Errorf("db is not restricted, got %v", got)
+	}
+	// An ingress rule with no peers or ports allows all traffic to db, before the drop.
+	if got := getPolicyAclRules(policies, ns, "web"); len(got) != len(policyAlwaysAllowed)+4 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestMeterPolicyAclRules(t *testing.T) {
+	rules := []string{policyAclRule("eth_type: 0x800", true), policyAclRule("eth_type: 0x86dd", false)}
+	want := []string{
+		"{rule: {eth_type: 0x800, actions: {meter: m, allow: 1}}}",
+		"{rule: {eth_type: 0x86dd, actions: {allow: 0}}}",
+	}
+	if got := meterPolicyAclRules(rules, "m"); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
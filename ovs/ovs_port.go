@@ -80,7 +80,7 @@ func (ovsdber *ovsdber) mustLowestFreePortOnBridge(bridgeName string) OFPortType
 func (ovsdber *ovsdber) addInternalPort(bridgeName string, portName string, tag uint) (OFPortType, string, error) {
 	lowestFreePort := ovsdber.mustLowestFreePortOnBridge(bridgeName)
 	if tag != 0 {
-		value, err := VsCtl("add-port", bridgeName, portName, fmt.Sprintf("tag=%u", tag), "--", "set", "Interface", portName, fmt.Sprintf("ofport_request=%d", lowestFreePort))
+		value, err := VsCtl("add-port", bridgeName, portName, fmt.Sprintf("tag=%d", tag), "--", "set", "Interface", portName, fmt.Sprintf("ofport_request=%d", lowestFreePort))
 		return lowestFreePort, value, err
 	}
 	value, err := VsCtl("add-port", bridgeName, portName, "--", "set", "Interface", portName, fmt.Sprintf("ofport_request=%d", lowestFreePort))
@@ -142,7 +142,11 @@ func (ovsdber *ovsdber) mustDeletePort(bridgeName string, portName string) {
 }
 
 func (ovsdber *ovsdber) getOfPort(portName string) (OFPortType, error) {
-	ofPort, err := ParseUint32(mustVsCtl("get", "Interface", portName, "ofport"))
+	output, err := VsCtl("get", "Interface", portName, "ofport")
+	if err != nil {
+		return OFPortType(0), err
+	}
+	ofPort, err := ParseUint32(output)
 	if err != nil {
 		return OFPortType(0), err
 	}
@@ -0,0 +1,185 @@
+package ovs
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	portSecurityAclPrefix = "dovesnap-portsec-"
+	// faucetMaxWildcardTableSize is FAUCET's default max_wildcard_table_size. The port ACL table holds
+	// the rules of every port's ACLs on a DP.
+	faucetMaxWildcardTableSize = 8192
+)
+
+// addrPrefix is a prefix of a MAC or IP address, as bytes and a length in bits.
+type addrPrefix struct {
+	addr []byte
+	len  int
+}
+
+func addrBit(addr []byte, i int) byte {
+	return (addr[i/8] >> (7 - i%8)) & 1
+}
+
+func (p addrPrefix) contains(q addrPrefix) bool {
+	if q.len < p.len {
+		return false
+	}
+	for i := 0; i < p.len; i++ {
+		if addrBit(p.addr, i) != addrBit(q.addr, i) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p addrPrefix) mask() []byte {
+	mask := make([]byte, len(p.addr))
+	for i := 0; i < p.len; i++ {
+		mask[i/8] |= 1 << (7 - i%8)
+	}
+	return mask
+}
+
+func (p addrPrefix) macString() string {
+	return fmt.Sprintf("%s/%s", net.HardwareAddr(p.addr), net.HardwareAddr(p.mask()))
+}
+
+func (p addrPrefix) ipString() string {
+	return (&net.IPNet{IP: p.addr, Mask: p.mask()}).String()
+}
+
+func ipPrefix(ipNet *net.IPNet) addrPrefix {
+	ones, _ := ipNet.Mask.Size()
+	addr := ipNet.IP.To4()
+	if addr == nil {
+		addr = ipNet.IP.To16()
+	}
+	return addrPrefix{addr: addr, len: ones}
+}
+
+func hostPrefix(ip net.IP) addrPrefix {
+	if ip4 := ip.To4(); ip4 != nil {
+		return addrPrefix{addr: ip4, len: 32}
+	}
+	return addrPrefix{addr: ip.To16(), len: 128}
+}
+
+// getPrefixComplement returns the fewest prefixes, within a prefix, that cover every address not in the allowed prefixes.
+// FAUCET ACL rules cannot negate a match, and a rule that allows traffic ends processing of the port's ACLs, so
+// port security drops traffic from these prefixes instead, leaving the rest to the port's other ACLs.
+func getPrefixComplement(allowed []addrPrefix, prefix addrPrefix) []addrPrefix {
+	overlaps := false
+	for _, allowedPrefix := range allowed {
+		if allowedPrefix.contains(prefix) {
+			return nil
+		}
+		if prefix.contains(allowedPrefix) {
+			overlaps = true
+		}
+	}
+	if !overlaps {
+		return []addrPrefix{prefix}
+	}
+	complement := []addrPrefix{}
+	for _, bit := range []byte{0, 1} {
+		child := addrPrefix{addr: slices.Clone(prefix.addr), len: prefix.len + 1}
+		child.addr[prefix.len/8] |= bit << (7 - prefix.len%8)
+		complement = append(complement, getPrefixComplement(allowed, child)...)
+	}
+	return complement
+}
+
+func portSecurityAclName(endpointID string) string {
+	return portSecurityAclPrefix + vethPair(truncateID(endpointID)).Name
+}
+
+// networkHasIPv6 returns true if a network routes IPv6, or any of a container's addresses are IPv6.
+func networkHasIPv6(ns NetworkState, ips []net.IP) bool {
+	if ns.Gateway6 != "" || ns.IPv6RA || (ns.Gateway != "" && ipFamily(ns.Gateway) == netlink.FAMILY_V6) {
+		return true
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getPortSecurityAclRules returns rules that drop frames not from a container's MAC, IP packets not from its
+// addresses, and ARP not for them. The unspecified address (for DHCP, ARP probes and duplicate address detection)
+// and IPv6 link local addresses (for neighbor discovery) are allowed. IPv6 source addresses are only checked
+// if the network has IPv6, as that takes over a hundred rules.
+func getPortSecurityAclRules(macAddress string, ips []net.IP, ipv6 bool) []string {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		panic(err)
+	}
+	_, linkLocal, _ := net.ParseCIDR("fe80::/10")
+	allowedMACs := []addrPrefix{{addr: mac, len: 48}}
+	allowedIPv4s := []addrPrefix{hostPrefix(net.IPv4zero)}
+	allowedIPv6s := []addrPrefix{hostPrefix(net.IPv6unspecified), ipPrefix(linkLocal)}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			allowedIPv4s = append(allowedIPv4s, hostPrefix(ip))
+		} else {
+			allowedIPv6s = append(allowedIPv6s, hostPrefix(ip))
+		}
+	}
+	anyMAC := addrPrefix{addr: make([]byte, 6)}
+	anyIPv4 := addrPrefix{addr: make([]byte, net.IPv4len)}
+	anyIPv6 := addrPrefix{addr: make([]byte, net.IPv6len)}
+
+	rules := []string{}
+	for _, prefix := range getPrefixComplement(allowedMACs, anyMAC) {
+		rules = append(rules, policyAclRule(fmt.Sprintf("eth_src: \"%s\"", prefix.macString()), false))
+	}
+	for _, prefix := range getPrefixComplement(allowedMACs, anyMAC) {
+		rules = append(rules, policyAclRule(fmt.Sprintf("eth_type: 0x806, arp_sha: \"%s\"", prefix.macString()), false))
+	}
+	for _, prefix := range getPrefixComplement(allowedIPv4s, anyIPv4) {
+		rules = append(rules, policyAclRule(fmt.Sprintf("eth_type: 0x806, arp_spa: \"%s\"", prefix.ipString()), false))
+	}
+	for _, prefix := range getPrefixComplement(allowedIPv4s, anyIPv4) {
+		rules = append(rules, policyAclRule(fmt.Sprintf("eth_type: 0x800, ipv4_src: \"%s\"", prefix.ipString()), false))
+	}
+	if !ipv6 {
+		return rules
+	}
+	for _, prefix := range getPrefixComplement(allowedIPv6s, anyIPv6) {
+		rules = append(rules, policyAclRule(fmt.Sprintf("eth_type: 0x86dd, ipv6_src: \"%s\"", prefix.ipString()), false))
+	}
+	return rules
+}
+
+// mustSetPortSecurityAcl sets (if changed) a container's port security ACL in FAUCET, and returns its name.
+func (d *Driver) mustSetPortSecurityAcl(networkID string, endpointID string, containerState ContainerState) string {
+	aclName := portSecurityAclName(endpointID)
+	ns := d.networks[networkID]
+	ips := getContainerIPs(containerState)
+	rules := getPortSecurityAclRules(containerState.MacAddress, ips, networkHasIPv6(ns, ips))
+	ruleCount := len(rules)
+	for otherEndpointID, otherState := range ns.DynamicNetworkStates.Containers {
+		if otherEndpointID != endpointID {
+			ruleCount += d.portSecurityRules[otherState.PortSecurityAcl]
+		}
+	}
+	if ruleCount > faucetMaxWildcardTableSize {
+		panic(fmt.Errorf("port security on %s would need %d FAUCET port ACL rules, more than %d", ns.NetworkName, ruleCount, faucetMaxWildcardTableSize))
+	}
+	d.portSecurityRules[aclName] = len(rules)
+	aclYaml := fmt.Sprintf("%s: [%s]", aclName, strings.Join(rules, ", "))
+	if d.faucetAcls[aclName] != aclYaml {
+		d.faucetconfrpcer.mustSetFaucetConfigFile(fmt.Sprintf("{acls: {%s}}", aclYaml))
+		d.faucetAcls[aclName] = aclYaml
+		log.Infof("Set port security ACL %s on %s", aclName, containerState.Name)
+	}
+	return aclName
+}
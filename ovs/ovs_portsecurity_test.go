@@ -0,0 +1,91 @@
+package ovs
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func uint16Prefix(addr uint16, len int) addrPrefix {
+	prefix := addrPrefix{addr: make([]byte, 2), len: len}
+	binary.BigEndian.PutUint16(prefix.addr, addr)
+	return prefix
+}
+
+// checkComplement checks that every address in a 16 bit space is in exactly one of the allowed prefixes or the
+// complement.
+func checkComplement(t *testing.T, allowed []addrPrefix) {
+	t.Helper()
+	complement := getPrefixComplement(allowed, uint16Prefix(0, 0))
+	for addr := 0; addr <= 0xffff; addr++ {
+		host := uint16Prefix(uint16(addr), 16)
+		inAllowed := false
+		for _, prefix := range allowed {
+			if prefix.contains(host) {
+				inAllowed = true
+			}
+		}
+		inComplement := 0
+		for _, prefix := range complement {
+			if prefix.contains(host) {
+				inComplement++
+			}
+		}
+		if inAllowed && inComplement != 0 {
+			t.Fatalf("allowed address %x is in the complement %v", addr, complement)
+		}
+		if !inAllowed && inComplement != 1 {
+			t.Fatalf("address %x is in %d complement prefixes, not 1", addr, inComplement)
+		}
+	}
+}
+
+func TestGetPrefixComplement(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allowed []addrPrefix
+		want    int
+	}{
+		{"nothing allowed", []addrPrefix{}, 1},
+		{"everything allowed", []addrPrefix{uint16Prefix(0, 0)}, 0},
+		{"one host", []addrPrefix{uint16Prefix(0x1234, 16)}, 16},
+		{"first and last hosts", []addrPrefix{uint16Prefix(0, 16), uint16Prefix(0xffff, 16)}, 30},
+		{"prefix and host", []addrPrefix{uint16Prefix(0xfe80, 10), uint16Prefix(0x0102, 16)}, 24},
+		{"overlapping", []addrPrefix{uint16Prefix(0x1200, 8), uint16Prefix(0x1234, 16)}, 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checkComplement(t, tc.allowed)
+			if got := len(getPrefixComplement(tc.allowed, uint16Prefix(0, 0))); got != tc.want {
+				t.Errorf("got %d prefixes, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddrPrefixStrings(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	if got := ipPrefix(ipNet).ipString(); got != "10.0.0.0/8" {
+		t.Errorf("got %s", got)
+	}
+	if got := hostPrefix(net.ParseIP("fd00::1")).ipString(); got != "fd00::1/128" {
+		t.Errorf("got %s", got)
+	}
+	mac, _ := net.ParseMAC("0e:00:00:00:00:00")
+	if got := (addrPrefix{addr: mac, len: 7}).macString(); got != "0e:00:00:00:00:00/fe:00:00:00:00:00" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestGetPortSecurityAclRules(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.2")}
+	ipv4Rules := getPortSecurityAclRules("0e:00:00:00:00:01", ips, false)
+	ipv6Rules := getPortSecurityAclRules("0e:00:00:00:00:01", ips, true)
+	if len(ipv6Rules) <= len(ipv4Rules) {
+		t.Errorf("IPv6 did not add rules: %d, %d", len(ipv4Rules), len(ipv6Rules))
+	}
+	// 48 each for eth_src and arp_sha, and 58 each for arp_spa and ipv4_src (allowing 0.0.0.0 and 10.0.0.2,
+	// which share a 4 bit prefix).
+	if len(ipv4Rules) != 48+48+58+58 {
+		t.Errorf("got %d IPv4 rules", len(ipv4Rules))
+	}
+}
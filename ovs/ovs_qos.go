@@ -0,0 +1,156 @@
+package ovs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	qosPortExternalID = "dovesnap_port"
+	rateMeterPrefix   = "dovesnap-rate-"
+)
+
+var rateUnits = map[string]uint64{
+	"":     1,
+	"kbit": 1,
+	"mbit": 1000,
+	"gbit": 1000 * 1000,
+}
+
+// RateLimits are a container's rate limits in kbps (0 for no limit). Ingress is traffic to the container, and egress is traffic from it.
+type RateLimits struct {
+	IngressKbps uint64
+	EgressKbps  uint64
+	// FAUCET meter limiting egress, on userspace bridges.
+	Meter string
+}
+
+// parseRate parses a rate in kbps, or with a unit (e.g. 10mbit).
+func parseRate(rateStr string) (uint64, error) {
+	rateStr = strings.ToLower(strings.TrimSpace(rateStr))
+	number := strings.TrimRightFunc(rateStr, func(r rune) bool { return r < '0' || r > '9' })
+	unit, ok := rateUnits[strings.TrimPrefix(rateStr, number)]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %s (units are kbit, mbit or gbit)", rateStr)
+	}
+	rate, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %s: %v", rateStr, err)
+	}
+	return rate * unit, nil
+}
+
+// mustGetRateLimits returns the rate limits from a container's labels, for a network.
+func mustGetRateLimits(ns NetworkState, labels map[string]string) RateLimits {
+	limits := RateLimits{}
+	for label, rate := range map[string]*uint64{
+		"dovesnap.ovs.ingress_rate": &limits.IngressKbps,
+		"dovesnap.ovs.egress_rate":  &limits.EgressKbps,
+	} {
+		rateStr := getStrForNetwork(labels[label], ns.NetworkName)
+		if rateStr == "" {
+			continue
+		}
+		kbps, err := parseRate(rateStr)
+		if err != nil {
+			panic(fmt.Errorf("%s: %v", label, err))
+		}
+		*rate = kbps
+	}
+	return limits
+}
+
+func rateMeterName(portName string) string {
+	return rateMeterPrefix + portName
+}
+
+// mustCheckMeteredPortAcl refuses a port ACL for a container whose egress a FAUCET meter limits. FAUCET applies only the
+// first rule that matches, so traffic the port ACL allowed would never reach the meter, and would not be limited.
+func mustCheckMeteredPortAcl(metered bool, portAcl string) {
+	if metered && portAcl != "" {
+		panic(fmt.Errorf("egress rate limits on a userspace bridge cannot be used with port ACLs (%s)", portAcl))
+	}
+}
+
+// getPortAcls returns a port's ACLs: any port security and policy ACLs, the port ACL, and any rate limiting meter.
+// Port security and policy ACLs leave traffic they do not drop (or allow) to the following ACLs, or if there are none,
+// allow it. A port with a meter has no port ACL (except the quarantine ACL), and its policy ACL meters what it allows.
+func getPortAcls(portSecurityAcl string, policyAcl string, portAcl string, limits RateLimits) string {
+	acls := []string{}
+	for _, acl := range []string{portSecurityAcl, policyAcl, portAcl, limits.Meter} {
+		if acl != "" {
+			acls = append(acls, acl)
+		}
+	}
+	if len(acls) > 0 && portAcl == "" && limits.Meter == "" {
+		// A port with ACLs drops traffic no ACL allows.
+		acls = append(acls, allowAllAcl)
+	}
+	return strings.Join(acls, ", ")
+}
+
+// mustSetIngressRate limits traffic OVS sends to a port, with an HTB QoS.
+func (ovsdber *ovsdber) mustSetIngressRate(portName string, kbps uint64) {
+	bps := fmt.Sprintf("other-config:max-rate=%d", kbps*1000)
+	externalID := fmt.Sprintf("external_ids:%s=%s", qosPortExternalID, portName)
+	mustVsCtl("--", "set", "Port", portName, "qos=@qos",
+		"--", "--id=@qos", "create", "QoS", "type=linux-htb", bps, externalID, "queues:0=@queue",
+		"--", "--id=@queue", "create", "Queue", bps, externalID)
+}
+
+// mustSetEgressRate limits traffic OVS receives from a port, by policing.
+func (ovsdber *ovsdber) mustSetEgressRate(portName string, kbps uint64) {
+	// Burst of 10% of the rate, as ovs-vswitchd.conf.db(5) recommends.
+	mustVsCtl("set", "Interface", portName,
+		fmt.Sprintf("ingress_policing_rate=%d", kbps), fmt.Sprintf("ingress_policing_burst=%d", kbps/10))
+}
+
+// clearRateLimits removes a port's QoS (which OVS does not garbage collect) and policing.
+func (ovsdber *ovsdber) clearRateLimits(portName string) {
+	VsCtl("--if-exists", "clear", "Port", portName, "qos")
+	VsCtl("--if-exists", "set", "Interface", portName, "ingress_policing_rate=0", "ingress_policing_burst=0")
+	for _, table := range []string{"QoS", "Queue"} {
+		uuids, err := VsCtl("--bare", "--columns=_uuid", "find", table, fmt.Sprintf("external_ids:%s=%s", qosPortExternalID, portName))
+		if err != nil {
+			continue
+		}
+		for _, uuid := range strings.Fields(uuids) {
+			if _, err := VsCtl("destroy", table, uuid); err != nil {
+				log.Warnf("cannot remove %s %s for %s: %v", table, uuid, portName, err)
+			}
+		}
+	}
+}
+
+// mustSetRateLimits applies a container's rate limits to its port. On userspace bridges, where OVS cannot police,
+// egress is limited by a FAUCET meter (which the caller must add to the port's ACLs).
+func (d *Driver) mustSetRateLimits(ns NetworkState, portName string, ofPort OFPortType, limits RateLimits) RateLimits {
+	if limits.IngressKbps > 0 {
+		d.ovsdber.mustSetIngressRate(portName, limits.IngressKbps)
+	}
+	if limits.EgressKbps > 0 {
+		if ns.Userspace {
+			limits.Meter = rateMeterName(portName)
+			d.faucetconfrpcer.mustSetFaucetConfigFile(d.faucetconfrpcer.rateMeterYaml(limits.Meter, ofPort, limits.EgressKbps))
+		} else {
+			d.ovsdber.mustSetEgressRate(portName, limits.EgressKbps)
+		}
+	}
+	return limits
+}
+
+// clearRateLimits removes any rate limits from a container's port.
+func (d *Driver) clearRateLimits(portName string, limits RateLimits) {
+	d.ovsdber.clearRateLimits(portName)
+	if limits.Meter == "" {
+		return
+	}
+	for _, key := range []string{"acls", "meters"} {
+		if err := d.faucetconfrpcer.deleteConfigKeys(fmt.Sprintf("[%s, %s]", key, limits.Meter)); err != nil {
+			log.Warnf("cannot delete FAUCET %s %s: %v", key, limits.Meter, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ovs
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuarantineState records who quarantined a container, when and why. By is the requester's IP, and User is the user
+// the request claimed to be from (which is not authenticated).
+type QuarantineState struct {
+	By     string
+	User   string
+	Reason string
+	Time   int64
+}
+
+// mustGetQuarantinePortConfig returns the port ACL and VLANs of a quarantined container's port, given its unquarantined ones.
+func (d *Driver) mustGetQuarantinePortConfig(ns NetworkState, portAcl string, vlan uint, taggedVlans []uint) (string, uint, []uint) {
+	if d.quarantineAcl == "" && d.quarantineVlan == 0 {
+		panic(fmt.Errorf("quarantine ACL or VLAN is not configured"))
+	}
+	if d.quarantineAcl != "" {
+		portAcl = d.quarantineAcl
+	}
+	if d.quarantineVlan != 0 {
+		if d.quarantineVlan != ns.BridgeVLAN && !d.faucetconfrpcer.mustGetDpVlans(ns.NetworkName)[d.quarantineVlan] {
+			panic(fmt.Errorf("quarantine VLAN %d is not defined on %s", d.quarantineVlan, ns.NetworkName))
+		}
+		vlan = d.quarantineVlan
+		taggedVlans = []uint{}
+	}
+	return portAcl, vlan, taggedVlans
+}
+
+// mustSetContainerPort changes a joined container's port ACL and VLANs in FAUCET.
+func mustSetContainerPort(d *Driver, ns NetworkState, containerState *ContainerState, portAcl string, vlan uint, taggedVlans []uint) {
+	if len(containerState.TaggedVLANs) > 0 && len(taggedVlans) == 0 {
+		// Merging the interface's config would leave its tagged VLANs in place.
+		if err := d.faucetconfrpcer.deleteConfigKeys(fmt.Sprintf("[dps, %s, interfaces, %d, tagged_vlans]", ns.NetworkName, containerState.OFPort)); err != nil {
+			panic(fmt.Errorf("cannot remove tagged VLANs from %s: %v", containerState.Name, err))
+		}
+	}
+	portDescription := fmt.Sprintf("%s %s", containerState.Name, truncateID(containerState.Id))
+	portAcls := getPortAcls(containerState.PortSecurityAcl, containerState.PolicyAcl, portAcl, containerState.RateLimits)
+	add_interfaces := d.faucetconfrpcer.vlanInterfaceYaml(containerState.OFPort, portDescription, vlan, portAcls)
+	if len(taggedVlans) > 0 {
+		add_interfaces = d.faucetconfrpcer.taggedVlanInterfaceYaml(containerState.OFPort, portDescription, vlan, taggedVlans, portAcls)
+	}
+	d.faucetconfrpcer.mustSetFaucetConfigFile(d.faucetconfrpcer.mergeSingleDpMinimalYaml(ns.NetworkName, add_interfaces))
+	log.Infof("Set portacl %s, VLAN %d, tagged VLANs %s on %s", portAcl, vlan, formatVLANs(taggedVlans), containerState.Name)
+	containerState.PortAcl = portAcl
+	containerState.VLAN = vlan
+	containerState.TaggedVLANs = taggedVlans
+}
+
+// mustHandleQuarantine moves a container's port to the quarantine ACL and/or VLAN and mirrors it, or releases it
+// (restoring the port ACL, VLANs and mirroring from its labels, and any other overrides).
+func mustHandleQuarantine(d *Driver, opMsg DovesnapOp, OFPorts *map[string]OFPortContainer) {
+	reply := DovesnapOpReply{}
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			log.Errorf("mustHandleQuarantine failed: %v", rerr)
+			reply.Err = fmt.Errorf("%v", rerr)
+		}
+		opMsg.Reply <- reply
+	}()
+
+	endpointID := mustFindJoinedEndpoint(d, opMsg.Container, opMsg.NetworkName, OFPorts)
+	containerMap := (*OFPorts)[endpointID]
+	ns := d.networks[containerMap.NetworkID]
+	containerState := ns.DynamicNetworkStates.Containers[endpointID]
+	key := containerOverrideKey(ns.NetworkName, containerMap.containerInspect.ID)
+	override := d.containerOverrides[key]
+	// Who requested the quarantine or release, and when.
+	request := opMsg.Override.Quarantine
+
+	portAcl := getLabelPortAcl(ns, endpointID, containerState.Labels)
+	if override.PortAcl != nil {
+		portAcl = *override.PortAcl
+	}
+	vlan, taggedVlans := mustGetLabelVLANs(d, ns, containerState.Labels, containerState.Name)
+	mirror := getLabelMirror(ns, containerState.Labels)
+	if override.Mirror != nil {
+		mirror = *override.Mirror
+	}
+
+	operation := "RELEASE"
+	if opMsg.Operation == "quarantine" {
+		operation = "QUARANTINE"
+		portAcl, vlan, taggedVlans = d.mustGetQuarantinePortConfig(ns, portAcl, vlan, taggedVlans)
+		mirror = true
+	} else if override.Quarantine == nil {
+		panic(fmt.Errorf("container %s is not quarantined", containerState.Name))
+	}
+
+	mustSetContainerPort(d, ns, &containerState, portAcl, vlan, taggedVlans)
+	if usingStackMirroring(d) || usingMirrorBridge(d) {
+		mustApplyMirror(d, containerMap.NetworkID, &containerState, mirror)
+	} else if opMsg.Operation == "quarantine" {
+		log.Warnf("mirroring is not configured, not mirroring quarantined container %s", containerState.Name)
+	}
+
+	override.Quarantine = nil
+	if opMsg.Operation == "quarantine" {
+		override.Quarantine = request
+	}
+	if override.PortAcl == nil && override.Mirror == nil && override.Quarantine == nil {
+		delete(d.containerOverrides, key)
+	} else {
+		d.containerOverrides[key] = override
+	}
+	d.containerOverrides.save()
+	containerState.Override = override
+	ns.DynamicNetworkStates.Containers[endpointID] = containerState
+	// Quarantined containers have no policy ACL, and released ones get theirs back.
+	compilePolicies(d, containerMap.NetworkID)
+	containerState = ns.DynamicNetworkStates.Containers[endpointID]
+
+	log.Warnf("%s %s by %s (claimed user %q): %s", operation, containerState.Name, request.By, request.User, request.Reason)
+	d.notifyMsgChan <- NotifyMsg{
+		Type:         "CONTAINER",
+		Operation:    operation,
+		NetworkState: ns,
+		Details: map[string]string{
+			"name":         containerState.Name,
+			"id":           containerState.Id,
+			"port":         fmt.Sprintf("%d", containerState.OFPort),
+			"by":           request.By,
+			"user":         request.User,
+			"reason":       request.Reason,
+			"time":         fmt.Sprintf("%d", request.Time),
+			"acls_in":      containerState.PortAcl,
+			"vlan":         fmt.Sprintf("%d", containerState.VLAN),
+			"tagged_vlans": formatVLANs(containerState.TaggedVLANs),
+			"mirror":       fmt.Sprintf("%t", containerState.Mirror),
+		},
+	}
+}
+
+// handleQuarantineWeb quarantines (with an optional reason) or releases a container. The requesting IP, and the
+// user the request claims (if given, and unauthenticated), are recorded separately.
+func (d *Driver) handleQuarantineWeb(w http.ResponseWriter, r *http.Request, operation string) {
+	remoteIP := getRemoteIp(r)
+	if !isAuthIP(remoteIP, d.authIPs) {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+	if !checkWebPost(w, r) {
+		return
+	}
+	container := r.FormValue("container")
+	if container == "" {
+		http.Error(w, "container required", http.StatusBadRequest)
+		return
+	}
+	requestMsg := DovesnapOp{
+		Operation:   operation,
+		Container:   container,
+		NetworkName: r.FormValue("network"),
+		Override: ContainerOverride{
+			Quarantine: &QuarantineState{By: remoteIP.String(), User: r.FormValue("user"), Reason: r.FormValue("reason"), Time: time.Now().Unix()},
+		},
+		Reply: make(chan DovesnapOpReply, 2),
+	}
+	log.Infof("web request from %s to %s %s", remoteIP, operation, container)
+	d.dovesnapOpChan <- requestMsg
+	reply := <-requestMsg.Reply
+	if reply.Err != nil {
+		http.Error(w, reply.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
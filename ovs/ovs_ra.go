@@ -0,0 +1,310 @@
+package ovs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// RFC 4861 6.2.1 and 10 defaults.
+	raMaxInterval        = 600 * time.Second
+	raInitialInterval    = 16 * time.Second
+	raInitialCount       = 3
+	raMinDelay           = 3 * time.Second
+	raHopLimit           = 64
+	raRouterLifetime     = 1800
+	raValidLifetime      = 86400
+	raPreferredLifetime  = 14400
+	raFlagOtherConfig    = 0x40
+	raPrefixFlagOnLink   = 0x80
+	raPrefixFlagAutoconf = 0x40
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptMTU            = 5
+	ndOptRDNSS          = 25
+)
+
+// raServer sends router advertisements (and answers stateless DHCPv6 requests for DNS servers) on a routed network's bridge.
+type raServer struct {
+	iface    *net.Interface
+	prefix   *net.IPNet
+	mtu      uint
+	dns      []net.IP
+	conn     *ipv6.PacketConn
+	dhcp     *server6.Server
+	solicits chan struct{}
+	quit     chan struct{}
+}
+
+// parseIPv6DNS parses a comma separated list of IPv6 DNS servers.
+func parseIPv6DNS(dnsStr string) ([]net.IP, error) {
+	dns := []net.IP{}
+	if dnsStr == "" {
+		return dns, nil
+	}
+	for _, addr := range strings.Split(dnsStr, ",") {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 DNS server %s", addr)
+		}
+		dns = append(dns, ip)
+	}
+	return dns, nil
+}
+
+// getIPv6Prefix returns the IPv6 prefix of a network's gateway, if it has one.
+func getIPv6Prefix(ns NetworkState) *net.IPNet {
+	for _, cidr := range getGatewayCidrs(ns) {
+		if ipFamily(cidr) != netlink.FAMILY_V6 {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err == nil {
+			return prefix
+		}
+	}
+	return nil
+}
+
+func ndOpt(optType byte, body []byte) []byte {
+	return append([]byte{optType, byte((len(body) + 2) / 8)}, body...)
+}
+
+// routerAdvertisement returns the body of a router advertisement for the network.
+func (ra *raServer) routerAdvertisement() []byte {
+	flags := byte(0)
+	if len(ra.dns) > 0 {
+		flags |= raFlagOtherConfig
+	}
+	body := []byte{raHopLimit, flags}
+	body = binary.BigEndian.AppendUint16(body, raRouterLifetime)
+	// Reachable time and retransmit timer unspecified.
+	body = append(body, make([]byte, 8)...)
+
+	body = append(body, ndOpt(ndOptSourceLinkAddr, ra.iface.HardwareAddr)...)
+
+	mtu := binary.BigEndian.AppendUint32(make([]byte, 2), uint32(ra.mtu))
+	body = append(body, ndOpt(ndOptMTU, mtu)...)
+
+	ones, _ := ra.prefix.Mask.Size()
+	prefixFlags := byte(raPrefixFlagOnLink)
+	// SLAAC requires a /64.
+	if ones == 64 {
+		prefixFlags |= raPrefixFlagAutoconf
+	}
+	prefixInfo := []byte{byte(ones), prefixFlags}
+	prefixInfo = binary.BigEndian.AppendUint32(prefixInfo, raValidLifetime)
+	prefixInfo = binary.BigEndian.AppendUint32(prefixInfo, raPreferredLifetime)
+	prefixInfo = append(prefixInfo, make([]byte, 4)...)
+	prefixInfo = append(prefixInfo, ra.prefix.IP.To16()...)
+	body = append(body, ndOpt(ndOptPrefixInfo, prefixInfo)...)
+
+	if len(ra.dns) > 0 {
+		rdnss := binary.BigEndian.AppendUint32(make([]byte, 2), uint32(3*raMaxInterval/time.Second))
+		for _, ip := range ra.dns {
+			rdnss = append(rdnss, ip.To16()...)
+		}
+		body = append(body, ndOpt(ndOptRDNSS, rdnss)...)
+	}
+	return body
+}
+
+func (ra *raServer) send() error {
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Body: &icmp.RawBody{Data: ra.routerAdvertisement()},
+	}
+	// The kernel calculates the checksum for ICMPv6 sockets.
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = ra.conn.WriteTo(b, nil, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: ra.iface.Name})
+	return err
+}
+
+// receive signals router solicitations, until the connection is closed.
+func (ra *raServer) receive() {
+	buf := make([]byte, ra.iface.MTU)
+	for {
+		n, _, _, err := ra.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n == 0 || ipv6.ICMPType(buf[0]) != ipv6.ICMPTypeRouterSolicitation {
+			continue
+		}
+		select {
+		case ra.solicits <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advertise sends unsolicited advertisements periodically (more often at first, per RFC 4861), and in reply to solicitations.
+func (ra *raServer) advertise() {
+	sent := 0
+	lastSent := time.Time{}
+	for {
+		interval := raMaxInterval
+		if sent < raInitialCount {
+			interval = raInitialInterval
+		}
+		select {
+		case <-ra.quit:
+			return
+		case <-ra.solicits:
+			if time.Since(lastSent) < raMinDelay {
+				continue
+			}
+		case <-time.After(interval):
+		}
+		if err := ra.send(); err != nil {
+			log.Warnf("cannot send router advertisement on %s: %v", ra.iface.Name, err)
+			continue
+		}
+		sent++
+		lastSent = time.Now()
+	}
+}
+
+// handleDHCPv6 answers information requests with the network's DNS servers. Addresses come from SLAAC.
+func (ra *raServer) handleDHCPv6(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, ok := m.(*dhcpv6.Message)
+	if !ok || msg.Type() != dhcpv6.MessageTypeInformationRequest {
+		return
+	}
+	serverID := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: ra.iface.HardwareAddr}
+	reply, err := dhcpv6.NewReplyFromMessage(msg, dhcpv6.WithServerID(serverID), dhcpv6.WithDNS(ra.dns...))
+	if err != nil {
+		log.Warnf("cannot reply to DHCPv6 request on %s: %v", ra.iface.Name, err)
+		return
+	}
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Warnf("cannot send DHCPv6 reply on %s: %v", ra.iface.Name, err)
+	}
+}
+
+// listenICMPv6 returns a connection for router solicitations and advertisements, bound to an interface.
+func listenICMPv6(iface *net.Interface) (*ipv6.PacketConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), iface.Name)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	c, err := lc.ListenPacket(context.Background(), "ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	conn := ipv6.NewPacketConn(c)
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	for _, err := range []error{
+		conn.SetICMPFilter(&filter),
+		conn.SetMulticastHopLimit(255),
+		conn.SetHopLimit(255),
+		conn.SetMulticastInterface(iface),
+		conn.JoinGroup(iface, &net.IPAddr{IP: net.IPv6linklocalallrouters}),
+	} {
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func startRAServer(ns NetworkState) (*raServer, error) {
+	prefix := getIPv6Prefix(ns)
+	if prefix == nil {
+		return nil, fmt.Errorf("network has no IPv6 gateway")
+	}
+	dns, err := parseIPv6DNS(ns.IPv6DNS)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(ns.BridgeName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenICMPv6(iface)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for router solicitations: %v", err)
+	}
+	ra := &raServer{
+		iface:    iface,
+		prefix:   prefix,
+		mtu:      ns.MTU,
+		dns:      dns,
+		conn:     conn,
+		solicits: make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	// Advertise straight away, rather than waiting for a solicitation.
+	ra.solicits <- struct{}{}
+	if len(dns) > 0 {
+		ra.dhcp, err = server6.NewServer(iface.Name, nil, ra.handleDHCPv6)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot start DHCPv6 server: %v", err)
+		}
+		go ra.dhcp.Serve()
+	}
+	go ra.receive()
+	go ra.advertise()
+	return ra, nil
+}
+
+func (ra *raServer) stop() {
+	close(ra.quit)
+	ra.conn.Close()
+	if ra.dhcp != nil {
+		ra.dhcp.Close()
+	}
+}
+
+// startRA starts router advertisements on a routed network's bridge, if configured.
+func (d *Driver) startRA(networkID string, ns NetworkState) {
+	if !ns.IPv6RA {
+		return
+	}
+	d.stopRA(networkID)
+	ra, err := startRAServer(ns)
+	if err != nil {
+		log.Errorf("cannot start router advertisements on %s: %v", ns.BridgeName, err)
+		return
+	}
+	log.Infof("advertising %s on %s", ra.prefix, ns.BridgeName)
+	d.raServers[networkID] = ra
+}
+
+func (d *Driver) stopRA(networkID string) {
+	ra, ok := d.raServers[networkID]
+	if !ok {
+		return
+	}
+	ra.stop()
+	delete(d.raServers, networkID)
+}
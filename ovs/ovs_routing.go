@@ -0,0 +1,190 @@
+package ovs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	policyRouteTableBase  = 0x0d50000
+	policyRouteTableRange = 0x10000
+	policyRoutePriority   = 20000
+)
+
+// existingPolicyRouteTable returns the routing table a network's rules already use (e.g. from before dovesnap restarted).
+func existingPolicyRouteTable(ns NetworkState, rules []netlink.Rule) (int, bool) {
+	srcs := make(map[string]bool)
+	for _, cidr := range getGatewayCidrs(ns) {
+		if _, src, err := net.ParseCIDR(cidr); err == nil {
+			srcs[src.String()] = true
+		}
+	}
+	for _, rule := range rules {
+		if rule.Priority == policyRoutePriority+1 && rule.Src != nil && srcs[rule.Src.String()] &&
+			rule.Table >= policyRouteTableBase && rule.Table < policyRouteTableBase+policyRouteTableRange {
+			return rule.Table, true
+		}
+	}
+	return 0, false
+}
+
+// policyRouteTable returns the routing table for a network's bridge: the table its rules already use, else the
+// first table from a hash of the bridge's name that no rule or route uses (so that hash collisions are skipped).
+func policyRouteTable(ns NetworkState) (int, error) {
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list policy routing rules: %v", err)
+	}
+	if table, ok := existingPolicyRouteTable(ns, rules); ok {
+		return table, nil
+	}
+	inUse := make(map[int]bool)
+	for _, rule := range rules {
+		inUse[rule.Table] = true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ns.BridgeName))
+	for i := uint32(0); i < policyRouteTableRange; i++ {
+		table := policyRouteTableBase + int((h.Sum32()+i)%policyRouteTableRange)
+		if inUse[table] {
+			continue
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return 0, fmt.Errorf("cannot list routes in table %d: %v", table, err)
+		}
+		if len(routes) == 0 {
+			return table, nil
+		}
+	}
+	return 0, fmt.Errorf("no free policy routing table for %s", ns.BridgeName)
+}
+
+// policyRules returns the rules that route a network's traffic via its bind interface.
+// The first rule uses the main table for anything but a default route (so the host and
+// other networks are still reachable), and the second uses the network's own table, which
+// has only a default route via the bind interface.
+func policyRules(cidr string, table int) ([]*netlink.Rule, error) {
+	_, src, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	family := ipFamily(cidr)
+	mainRule := netlink.NewRule()
+	mainRule.Family = family
+	mainRule.Src = src
+	mainRule.Table = syscall.RT_TABLE_MAIN
+	mainRule.SuppressPrefixlen = 0
+	mainRule.Priority = policyRoutePriority
+	bindRule := netlink.NewRule()
+	bindRule.Family = family
+	bindRule.Src = src
+	bindRule.Table = table
+	bindRule.Priority = policyRoutePriority + 1
+	return []*netlink.Rule{mainRule, bindRule}, nil
+}
+
+// getDefaultRoute returns a route to use as the default via an interface, based on the host's default route(s).
+func getDefaultRoute(link netlink.Link, family int, table int) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     table,
+		Scope:     netlink.SCOPE_LINK,
+	}
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{LinkIndex: link.Attrs().Index}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return route
+	}
+	for _, hostRoute := range routes {
+		if hostRoute.Dst != nil {
+			if ones, _ := hostRoute.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if hostRoute.Gw != nil {
+			route.Gw = hostRoute.Gw
+			route.Scope = netlink.SCOPE_UNIVERSE
+		}
+		return route
+	}
+	log.Warnf("no default route via %s, assuming it is point to point", link.Attrs().Name)
+	return route
+}
+
+// addPolicyRouting pins a NAT or routed network's egress to its bind interface.
+func addPolicyRouting(ns NetworkState) error {
+	if ns.FlatBindInterface == "" || (ns.Mode != modeNAT && ns.Mode != modeRouted) {
+		return nil
+	}
+	link, err := netlink.LinkByName(ns.FlatBindInterface)
+	if err != nil {
+		return fmt.Errorf("cannot find bind interface %s: %v", ns.FlatBindInterface, err)
+	}
+	table, err := policyRouteTable(ns)
+	if err != nil {
+		return err
+	}
+	for _, cidr := range getGatewayCidrs(ns) {
+		rules, err := policyRules(cidr, table)
+		if err != nil {
+			return err
+		}
+		route := getDefaultRoute(link, rules[0].Family, table)
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("cannot add default route via %s to table %d: %v", ns.FlatBindInterface, table, err)
+		}
+		for _, rule := range rules {
+			if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+				return fmt.Errorf("cannot add policy routing rule %s: %v", rule, err)
+			}
+		}
+		log.Infof("routing %s via %s (table %d)", cidr, ns.FlatBindInterface, table)
+	}
+	return nil
+}
+
+func deletePolicyRouting(ns NetworkState) {
+	if ns.FlatBindInterface == "" || (ns.Mode != modeNAT && ns.Mode != modeRouted) {
+		return
+	}
+	existingRules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		log.Warnf("cannot delete policy routing for %s: %v", ns.BridgeName, err)
+		return
+	}
+	// Without a rule using the network's table, only its main table rule may remain.
+	table, ok := existingPolicyRouteTable(ns, existingRules)
+	for _, cidr := range getGatewayCidrs(ns) {
+		rules, err := policyRules(cidr, table)
+		if err != nil {
+			log.Warnf("cannot delete policy routing for %s: %v", ns.BridgeName, err)
+			continue
+		}
+		if !ok {
+			rules = rules[:1]
+		}
+		for _, rule := range rules {
+			if err := netlink.RuleDel(rule); err != nil {
+				log.Warnf("cannot delete policy routing rule %s: %v", rule, err)
+			}
+		}
+		if !ok {
+			continue
+		}
+		routes, err := netlink.RouteListFiltered(rules[0].Family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			continue
+		}
+		for _, route := range routes {
+			if err := netlink.RouteDel(&route); err != nil {
+				log.Warnf("cannot delete route %s from table %d: %v", route, table, err)
+			}
+		}
+	}
+}
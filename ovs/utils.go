@@ -7,6 +7,7 @@ import (
 	"math"
 	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -14,12 +15,18 @@ import (
 	bc "github.com/kenshaw/baseconv"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	b62alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 )
 
+var (
+	procNetNsRe   = regexp.MustCompile(`^/proc/\d+/ns/net$`)
+	containerIDRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
 func ParseUint32(value string) (uint32, error) {
 	uintValue, err := strconv.ParseUint(value, 10, 32)
 	if err == nil {
@@ -76,25 +83,90 @@ func patchStr(a string) string {
 	return b62Encode(int64(crc32.ChecksumIEEE([]byte(a))))
 }
 
-// Return the IPv4 address of a network interface
-func getIfaceAddr(name string) (*net.IPNet, error) {
+// Return the (non link local) address of a network interface, in an address family
+func getIfaceAddr(name string, family int) (*net.IPNet, error) {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	allAddrs, err := netlink.AddrList(iface, family)
 	if err != nil {
 		return nil, err
 	}
+	addrs := []netlink.Addr{}
+	for _, addr := range allAddrs {
+		if !addr.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, addr)
+		}
+	}
 	if len(addrs) == 0 {
 		return nil, fmt.Errorf("interface %s has no IP addresses", name)
 	}
 	if len(addrs) > 1 {
-		log.Infof("Interface [ %v ] has more than 1 IPv4 address. Defaulting to using [ %v ]\n", name, addrs[0].IP)
+		log.Infof("Interface [ %v ] has more than 1 address. Defaulting to using [ %v ]\n", name, addrs[0].IP)
 	}
 	return addrs[0].IPNet, nil
 }
 
+// Return the netlink address family of an IP address or CIDR
+func ipFamily(ip string) int {
+	if parsedIP := net.ParseIP(strings.Split(ip, "/")[0]); parsedIP != nil && parsedIP.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+// getIPv6Uplinks returns the interfaces of the host's IPv6 default routes.
+func getIPv6Uplinks() ([]string, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	uplinks := []string{}
+	for _, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		linkIndexes := []int{route.LinkIndex}
+		for _, nextHop := range route.MultiPath {
+			linkIndexes = append(linkIndexes, nextHop.LinkIndex)
+		}
+		for _, linkIndex := range linkIndexes {
+			if link, err := netlink.LinkByIndex(linkIndex); err == nil {
+				uplinks = append(uplinks, link.Attrs().Name)
+			}
+		}
+	}
+	return uplinks, nil
+}
+
+// Enable forwarding of IPv6 (docker only does this for its own IPv6 networks). Forwarding stops interfaces accepting
+// router advertisements, so uplinks (the bind interface, or else those of IPv6 default routes) that accept them are
+// set to accept them while forwarding (accept_ra=2), so that the host keeps its SLAAC addresses and default routes.
+func enableIPv6Forwarding(bindInterface string) error {
+	uplinks := []string{bindInterface}
+	if bindInterface == "" {
+		var err error
+		if uplinks, err = getIPv6Uplinks(); err != nil {
+			return err
+		}
+	}
+	for _, uplink := range uplinks {
+		acceptRaPath := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", uplink)
+		acceptRa, err := os.ReadFile(acceptRaPath)
+		if err != nil || strings.TrimSpace(string(acceptRa)) != "1" {
+			continue
+		}
+		if err := os.WriteFile(acceptRaPath, []byte("2"), 0644); err != nil {
+			return err
+		}
+		log.Infof("accepting router advertisements on %s while forwarding IPv6", uplink)
+	}
+	return os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+}
+
 func mustPrefixMAC(macPrefix string, macAddress string) string {
 	prefixBytes, err := hex.DecodeString(strings.ReplaceAll(macPrefix, ":", ""))
 	if err != nil {
@@ -154,6 +226,10 @@ func setInterfaceIP(name string, rawIP string) error {
 	if err != nil {
 		return err
 	}
+	if ipFamily(rawIP) == netlink.FAMILY_V6 {
+		// The gateway must be usable immediately.
+		addr.Flags = unix.IFA_F_NODAD
+	}
 	return netlink.AddrAdd(iface, addr)
 }
 
@@ -192,31 +268,30 @@ func ensureDirExists(dir string) {
 	}
 }
 
-func createNsLink(pid int, id string) {
-	procPath := fmt.Sprintf("/proc/%d/ns/net", pid)
-	procNetNsPath := fmt.Sprintf("%s/%s", netNsPath, id)
-
-	_, err := os.Lstat(procNetNsPath)
-	if err == nil {
-		log.Debugf("Remove existing %s", procNetNsPath)
-		err = os.Remove(procNetNsPath)
-		if err != nil {
-			panic(err)
-		}
-	}
-
-	err = os.Symlink(procPath, procNetNsPath)
+// Return the links made by earlier versions of dovesnap (to run ip netns exec in containers, named by container ID),
+// mapped to their (possibly stale) targets.
+func getNsLinks() map[string]string {
+	nsLinks := make(map[string]string)
+	entries, err := os.ReadDir(netNsPath)
 	if err != nil {
-		panic(err)
+		return nsLinks
 	}
+	for _, entry := range entries {
+		target, err := os.Readlink(fmt.Sprintf("%s/%s", netNsPath, entry.Name()))
+		if err != nil || !containerIDRe.MatchString(entry.Name()) || !procNetNsRe.MatchString(target) {
+			continue
+		}
+		nsLinks[entry.Name()] = target
+	}
+	return nsLinks
 }
 
-func deleteNsLink(id string) {
-	procNetNsPath := fmt.Sprintf("%s/%s", netNsPath, id)
-	os.Remove(procNetNsPath)
+func nsLinkStale(target string) bool {
+	_, err := os.Stat(target)
+	return err != nil
 }
 
-// Create veth pair. Peername is renamed to eth0 in the container
+// Create veth pair. Peername is renamed to ethN in the container
 func vethPair(suffix string) *netlink.Veth {
 	return &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{Name: ovsPortPrefix + suffix},
@@ -224,6 +299,21 @@ func vethPair(suffix string) *netlink.Veth {
 	}
 }
 
+// mustGetContainerIfName returns the name of an endpoint's interface in its container (which is not
+// always eth0, e.g. if the container is on more than one network), by finding the peer of the endpoint's veth.
+func mustGetContainerIfName(cns *containerNetNs, endpointID string) string {
+	hostLink := mustGetLinkByName(vethPair(truncateID(endpointID)).Name)
+	peerIndex := hostLink.Attrs().ParentIndex
+	if peerIndex == 0 {
+		panic(fmt.Errorf("cannot find peer of %s", hostLink.Attrs().Name))
+	}
+	ifName, err := cns.linkName(peerIndex)
+	if err != nil {
+		panic(err)
+	}
+	return ifName
+}
+
 func mustGetLinkByName(name string) netlink.Link {
 	iface, err := netlink.LinkByName(name)
 	if err != nil {